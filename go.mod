@@ -5,5 +5,7 @@ go 1.24.5
 require (
 	github.com/go-resty/resty/v2 v2.16.5 // indirect
 	golang.org/x/net v0.33.0 // indirect
+	golang.org/x/time v0.6.0 // indirect
 	gopkg.in/telebot.v3 v3.3.8 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
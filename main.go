@@ -1,16 +1,42 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"maps"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/go-resty/resty/v2"
+	"golang.org/x/time/rate"
 	"gopkg.in/telebot.v3"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
@@ -19,18 +45,359 @@ type Config struct {
 	OpenAIAPIURL   string `json:"openai_api_url"`
 	OpenAIModel    string `json:"openai_model"`
 	StartupMessage string `json:"startup_message"`
+
+	// OpenAIOrg and OpenAIProject, if set, are sent as the
+	// OpenAI-Organization and OpenAI-Project headers so usage is billed to
+	// the right organization and project
+	OpenAIOrg     string `json:"openai_org"`
+	OpenAIProject string `json:"openai_project"`
+
+	// StartupNotificationDelaySeconds, if set, delays the startup
+	// notifications by a random time up to this long, so instances
+	// restarted together don't all send at once
+	StartupNotificationDelaySeconds int `json:"startup_notification_delay_seconds"`
+
+	// With WebhookURL set, Telegram delivers updates to that public HTTPS
+	// URL, which must be proxied to WebhookListen, instead of the bot long
+	// polling. WebhookSecret, if set, is checked on every delivery.
+	WebhookURL    string `json:"webhook_url"`
+	WebhookListen string `json:"webhook_listen"`
+	WebhookSecret string `json:"webhook_secret"`
+
+	// HealthListen, if set, is the address (e.g. ":8081") of an HTTP server
+	// answering /healthz for container health checks
+	HealthListen string `json:"health_listen"`
+
+	// HTTPProxy, if set, is an http, https or socks5 proxy URL for all
+	// traffic to the LLM API and Telegram. Empty means HTTP_PROXY and
+	// HTTPS_PROXY from the environment are used.
+	HTTPProxy string `json:"http_proxy"`
+
+	// SystemMessage is the default system prompt, a text/template rendered
+	// with PromptData before each request. Empty means the built-in Frank
+	// prompt.
+	SystemMessage string `json:"system_message"`
+	// SystemMessageFile, if set, is a file read for SystemMessage at
+	// startup and again on FRANK RELOAD
+	SystemMessageFile string `json:"system_message_file"`
+	// PromptPreamble puts the current date and time and the chat's name in
+	// front of the system prompt on every request
+	PromptPreamble bool `json:"prompt_preamble"`
+	// TimeZone is the IANA time zone (e.g. "Europe/London") for the
+	// preamble and prompt template dates. Empty means the server's.
+	TimeZone string `json:"time_zone"`
+	// PrivateSystemMessage replaces SystemMessage in one-to-one chats.
+	// Empty means the built-in private Frank prompt.
+	PrivateSystemMessage string `json:"private_system_message"`
+	// PrivateBatchWindowSeconds overrides batch_window_seconds in private
+	// chats, e.g. 0 to reply straight away
+	PrivateBatchWindowSeconds *int `json:"private_batch_window_seconds"`
+
+	// TriggerWord prefixes bot commands, e.g. "FRANK STATUS"
+	TriggerWord string `json:"trigger_word"`
+	// AssistantName labels the bot's own messages in history, summaries
+	// and transcripts; a chat's persona uses its own name
+	AssistantName string `json:"assistant_name"`
+
+	// Personas are alternative characters a chat can switch to with
+	// FRANK PERSONA; Frank, as configured above, is the default
+	Personas []Persona `json:"personas"`
+
+	// Provider selects the API shape: "openai" (default) or "anthropic".
+	// The openai_* key, URL and model settings apply to whichever is chosen.
+	Provider string `json:"provider"`
+	// UseNameField sends each sender's name in the message name field
+	// instead of prefixing it to the text; not every endpoint supports it
+	UseNameField bool `json:"use_name_field"`
+	// ToolsEnabled offers the built-in tools (see newToolRegistry) to the
+	// model; chat completions only
+	ToolsEnabled bool `json:"tools_enabled"`
+	// APIFormat picks the OpenAI endpoint shape: "chat" (chat completions,
+	// default) or "responses" (the /v1/responses API)
+	APIFormat string `json:"api_format"`
+	// SkipModelValidation turns off the startup check that openai_model is
+	// listed by the API's models endpoint
+	SkipModelValidation bool `json:"skip_model_validation"`
+	// StopSequences end the reply when the model produces any of them; not
+	// supported with api_format "responses"
+	StopSequences []string `json:"stop_sequences"`
+
+	BatchWindowSeconds int  `json:"batch_window_seconds"`
+	StreamResponses    bool `json:"stream_responses"`
+	// MaxBatchWaitSeconds caps how long a batch can be put off by new
+	// messages restarting the window; 0 means no limit
+	MaxBatchWaitSeconds int `json:"max_batch_wait_seconds"`
+	// AutoContinue asks the model to carry on when a reply is cut off at
+	// the token limit, up to maxContinuations times; not when streaming
+	AutoContinue bool `json:"auto_continue"`
+	// ImmediateTrigger, if set, makes a message ending with it (e.g.
+	// "@frank") send the batch straight away instead of after the window
+	ImmediateTrigger string `json:"immediate_trigger"`
+	// MinTriggerLength is the fewest characters a message needs to start or
+	// extend the batch timer; shorter ones only join the batch
+	MinTriggerLength int `json:"min_trigger_length"`
+	// MembershipNotes adds a note to a chat's history when someone joins
+	// or leaves
+	MembershipNotes bool `json:"membership_notes"`
+	// MergeConsecutiveMessages joins back-to-back messages from the same
+	// sender within a batch into a single user turn
+	MergeConsecutiveMessages bool `json:"merge_consecutive_messages"`
+	// SeparateTopics gives each forum topic in a group its own
+	// conversation history instead of sharing one across the chat
+	SeparateTopics bool `json:"separate_topics"`
+
+	// MinReplyIntervalSeconds is how long Frank waits after replying before
+	// he answers a batch containing only messages from other bots
+	MinReplyIntervalSeconds int `json:"min_reply_interval_seconds"`
+
+	// With ProactiveEnabled Frank starts a conversation himself once a chat
+	// has been quiet for ProactiveIdleMinutes, but only between
+	// ProactiveStartHour and ProactiveEndHour (local time)
+	ProactiveEnabled     bool `json:"proactive_enabled"`
+	ProactiveIdleMinutes int  `json:"proactive_idle_minutes"`
+	ProactiveStartHour   *int `json:"proactive_start_hour"`
+	ProactiveEndHour     *int `json:"proactive_end_hour"`
+
+	// DryRun calls the model and logs its replies but never speaks in chats
+	DryRun bool `json:"dry_run"`
+
+	// HumanDelay pauses before sending a reply, longer for longer replies,
+	// to mimic typing time. Off when max_seconds is zero.
+	HumanDelay DelayRange `json:"human_delay"`
+
+	// Users on the blocklist are ignored; when the allowlist is non-empty
+	// only users on it are heard. Admins may use FRANK commands regardless.
+	AllowedUserIDs []int64 `json:"allowed_user_ids"`
+	BlockedUserIDs []int64 `json:"blocked_user_ids"`
+	AdminUserIDs   []int64 `json:"admin_user_ids"`
+	// ExportAdminOnly limits FRANK EXPORT to admins
+	ExportAdminOnly bool `json:"export_admin_only"`
+
+	// ResponseProbability is the chance (0-1) that Frank answers a batch in a
+	// group that doesn't mention him; unset means always
+	ResponseProbability *float64 `json:"response_probability"`
+
+	// IgnoreForwards drops forwarded messages instead of passing them to
+	// Frank marked as forwarded
+	IgnoreForwards bool `json:"ignore_forwards"`
+
+	// TranscriptFile, if set, is a file every message Frank sees or sends
+	// is appended to as a JSON line. Once it reaches TranscriptMaxBytes it
+	// is moved to TranscriptFile + ".1" and a new one started.
+	TranscriptFile     string `json:"transcript_file"`
+	TranscriptMaxBytes int64  `json:"transcript_max_bytes"`
+
+	// FeedbackLogPath, if set, is a file that 👍/👎 reactions to Frank's
+	// replies are appended to as JSON lines
+	FeedbackLogPath string `json:"feedback_log_path"`
+
+	// ReportErrorsToChat posts a short notice in the chat when an LLM call
+	// fails, so operators can see the bot is struggling
+	ReportErrorsToChat bool `json:"report_errors_to_chat"`
+
+	// IncludeTimestamps prefixes user lines sent to the model with their time
+	IncludeTimestamps bool `json:"include_timestamps"`
+
+	// ParseMode formats replies: "", "Markdown", "MarkdownV2" or "HTML"
+	ParseMode string `json:"parse_mode"`
+	// ReplyToMessage sends replies as a reply to the last message in the batch
+	ReplyToMessage bool `json:"reply_to_message"`
+
+	// MinInterest is the lowest interest level ("low", "medium" or "high")
+	// at which Frank actually sends his reply
+	MinInterest string `json:"min_interest"`
+
+	// RespondMode is "always", "mention" or "reply"
+	RespondMode string `json:"respond_mode"`
+
+	VisionEnabled bool `json:"vision_enabled"`
+
+	RequestTimeoutSeconds int `json:"request_timeout_seconds"`
+	// MaxConcurrentRequests caps LLM calls in flight across all chats
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// Per-chat limit on LLM calls; disabled when RateLimitPerMinute is 0
+	RateLimitPerMinute float64 `json:"rate_limit_per_minute"`
+	RateLimitBurst     int     `json:"rate_limit_burst"`
+	RateLimitNotice    string  `json:"rate_limit_notice"`
+
+	// After CircuitBreakerFailures LLM calls fail in a row, calls are
+	// skipped for CircuitBreakerCooldownSeconds before one is tried again;
+	// disabled when CircuitBreakerFailures is 0
+	CircuitBreakerFailures        int    `json:"circuit_breaker_failures"`
+	CircuitBreakerCooldownSeconds int    `json:"circuit_breaker_cooldown_seconds"`
+	CircuitBreakerNotice          string `json:"circuit_breaker_notice"`
+
+	// LogLevel is "debug", "info", "warn" or "error"
+	LogLevel string `json:"log_level"`
+
+	// Voice messages are transcribed when TranscriptionURL is set
+	TranscriptionURL    string `json:"transcription_url"`
+	TranscriptionModel  string `json:"transcription_model"`
+	TranscriptionAPIKey string `json:"transcription_api_key"`
+
+	OpenAITemperature *float64 `json:"openai_temperature"`
+	OpenAITopP        *float64 `json:"openai_top_p"`
+	OpenAIMaxTokens   *int     `json:"openai_max_tokens"`
+	// Penalties discouraging repetition, -2.0 to 2.0; chat completions only
+	FrequencyPenalty *float64 `json:"frequency_penalty"`
+	PresencePenalty  *float64 `json:"presence_penalty"`
+	// Seed asks the model for repeatable output; chat completions only,
+	// and not every backend honors it
+	Seed *int `json:"seed"`
+
+	OpenAIMaxRetries       *int `json:"openai_max_retries"`
+	OpenAIRetryBaseDelayMs int  `json:"openai_retry_base_delay_ms"`
+
+	// Prices in dollars per 1000 tokens, used to estimate what each chat
+	// costs in FRANK STATUS and the daily usage log
+	PromptPricePer1K     float64 `json:"prompt_price_per_1k"`
+	CompletionPricePer1K float64 `json:"completion_price_per_1k"`
+
+	MaxContextChars    int `json:"max_context_chars"`
+	MaxContextTokens   int `json:"max_context_tokens"`
+	MaxHistoryMessages int `json:"max_history_messages"`
+	// PinnedHistoryCount keeps the first messages of a conversation through
+	// trimming, which drops from just after them instead
+	PinnedHistoryCount int `json:"pinned_history_count"`
+
+	// AutoSummarizeMessages summarizes older history, as FRANK SUMMARIZE
+	// does, once a chat's history reaches this many messages; 0 disables
+	AutoSummarizeMessages int `json:"auto_summarize_messages"`
+	// ContextOverflowStrategy is how history is cut back when a request is
+	// too long for the model before it is retried: "trim" (drop the older
+	// half, default), "summarize", "pending" (keep only the batch) or
+	// "none" (give up)
+	ContextOverflowStrategy string `json:"context_overflow_strategy"`
+
+	// MessageLimit is the most bytes sent in one Telegram message; longer
+	// replies are split
+	MessageLimit int `json:"message_limit"`
+
+	// MaxMessageChars caps a single user message as it is received
+	// (default 4000); negative means no cap
+	MaxMessageChars int `json:"max_message_chars"`
+}
+
+// LogLevel controls which log messages are written
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// startTime records when the process started, for reporting uptime
+var startTime = time.Now()
+
+// logLevel is the minimum level written; set from config at startup
+var logLevel = LogLevelInfo
+
+// requestSlots is a semaphore holding one token per LLM call in flight,
+// sized by max_concurrent_requests in main
+var requestSlots = make(chan struct{}, 1)
+
+// llmBreaker is set from circuit_breaker_failures at startup; nil when off
+var llmBreaker *CircuitBreaker
+
+func parseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	}
+	return LogLevelInfo, fmt.Errorf("log_level must be \"debug\", \"info\", \"warn\" or \"error\", got %q", name)
+}
+
+func logAt(level LogLevel, prefix string, format string, args ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	log.Printf(prefix+format, args...)
+}
+
+func logDebug(format string, args ...interface{}) { logAt(LogLevelDebug, "DEBUG ", format, args...) }
+func logInfo(format string, args ...interface{})  { logAt(LogLevelInfo, "INFO ", format, args...) }
+func logWarn(format string, args ...interface{})  { logAt(LogLevelWarn, "WARN ", format, args...) }
+func logError(format string, args ...interface{}) { logAt(LogLevelError, "ERROR ", format, args...) }
+
+// logDebugJSON logs v as JSON at debug level, skipping the encoding work
+// entirely when debug logging is off
+func logDebugJSON(label string, v interface{}) {
+	if logLevel > LogLevelDebug {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		logDebug("%s: <unencodable: %v>", label, err)
+		return
+	}
+	logDebug("%s: %s", label, data)
 }
 
 type BotStatus struct {
-	ChatIDs []int64 `json:"chat_ids"`
-	mutex   sync.Mutex
+	ChatIDs      []int64                 `json:"chat_ids"`
+	ChatSettings map[int64]*ChatSettings `json:"chat_settings,omitempty"`
+	// LastMessageIDs is the highest message ID handled in each chat, so
+	// messages redelivered after a restart aren't handled twice
+	LastMessageIDs map[int64]int `json:"last_message_ids,omitempty"`
+	mutex          sync.Mutex
+	path           string
+	dirty          bool      // changed since the last save
+	idsChanged     bool      // LastMessageIDs changed since the last save
+	savedAt        time.Time // when the status was last saved
+
+	restoredIDs map[int64]int          // LastMessageIDs as loaded at startup
+	seen        map[int64]map[int]bool // message IDs handled since startup
+}
+
+// ChatSettings holds per-chat overrides that persist across restarts
+type ChatSettings struct {
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	Model        string `json:"model,omitempty"`
+	Persona      string `json:"persona,omitempty"`
+	// Language, if set, is the language Frank is told to reply in
+	Language string `json:"language,omitempty"`
+	// Temperature overrides openai_temperature when set
+	Temperature *float64 `json:"temperature,omitempty"`
+	// Muted chats stay tracked and keep their history, but Frank doesn't reply
+	Muted bool `json:"muted,omitempty"`
+	// Quiet chats get no startup notification
+	Quiet bool `json:"quiet,omitempty"`
+}
+
+// Persona is a named character with its own system prompt and trigger word
+type Persona struct {
+	Name          string `json:"name"`
+	SystemMessage string `json:"system_message"`
+	// TriggerWord is used for commands and mentions in chats using the
+	// persona, alongside the main trigger word; empty means the name
+	TriggerWord string `json:"trigger_word"`
+}
+
+// DelayRange is a range of delays in seconds
+type DelayRange struct {
+	MinSeconds float64 `json:"min_seconds"`
+	MaxSeconds float64 `json:"max_seconds"`
 }
 
 type Message struct {
-	Username  string
-	Text      string
-	Timestamp time.Time
-	IsBot     bool
+	Username     string
+	Text         string
+	Timestamp    time.Time
+	IsBot        bool
+	FromBot      bool // sent by another bot account
+	RepliesToBot bool
+	Images       []string         // data URLs of attached images
+	Source       *telebot.Message // Telegram message this came from, nil for bot replies
+	IsNote       bool             // an event such as someone joining, not something said
 }
 
 type ConversationContext struct {
@@ -38,122 +405,529 @@ type ConversationContext struct {
 	SystemMessage   string
 	PendingMessages []Message
 	LastMessageTime time.Time
+	FirstPendingAt  time.Time // when the oldest pending message arrived
 	Timer           *time.Timer
 	Mutex           sync.Mutex
+
+	// Model overrides config.OpenAIModel for this chat when non-empty
+	Model string
+	// Persona names the chat's entry in config.Personas, empty for Frank
+	Persona string
+	// Language is added to the system prompt as the language to reply in
+	Language string
+	// Temperature overrides config.OpenAITemperature for this chat when set
+	Temperature *float64
+
+	RateLimiter           *rate.Limiter // nil when rate limiting is disabled
+	LastRateLimitNoticeAt time.Time
+	LastBreakerNoticeAt   time.Time
+	LastErrorNoticeAt     time.Time
+
+	LastInterest   string         // most recent interest level Frank reported
+	InterestCounts map[string]int // interest level -> number of replies
+
+	ThumbsUp   int // 👍 reactions to Frank's replies since startup
+	ThumbsDown int
+
+	Usage      Usage // tokens used by this chat since startup
+	DailyUsage Usage // tokens used since the last daily usage log
+
+	// Summary condenses messages that were dropped by FRANK SUMMARIZE; it
+	// is sent along with the system message
+	Summary     string
+	Summarizing bool // an automatic summary is in progress
+
+	LastReplyAt     time.Time
+	LastProactiveAt time.Time
+	Chat            *telebot.Chat // as last seen, for messages Frank starts himself
 }
 
 type OpenAIRequest struct {
-	Model    string          `json:"model"`
-	Messages []OpenAIMessage `json:"messages"`
+	Model         string               `json:"model"`
+	Messages      []OpenAIMessage      `json:"messages"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	MaxTokens     *int                 `json:"max_tokens,omitempty"`
+	Stop          []string             `json:"stop,omitempty"`
+	Tools         []OpenAITool         `json:"tools,omitempty"`
+
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
 }
 
 type OpenAIMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string           `json:"role"`
+	Name       string           `json:"name,omitempty"`
+	Content    string           `json:"content"`
+	Images     []string         `json:"-"` // data URLs, sent as image content parts
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type OpenAITool struct {
+	Type     string             `json:"type"`
+	Function OpenAIToolFunction `json:"function"`
+}
+
+type OpenAIToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type OpenAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type OpenAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *OpenAIImageURL `json:"image_url,omitempty"`
+}
+
+type OpenAIImageURL struct {
+	URL string `json:"url"`
+}
+
+// MarshalJSON sends plain string content, switching to the multimodal
+// content array only when the message carries images
+func (m OpenAIMessage) MarshalJSON() ([]byte, error) {
+	type plainMessage OpenAIMessage
+	if len(m.Images) == 0 {
+		return json.Marshal(plainMessage(m))
+	}
+
+	parts := []OpenAIContentPart{{Type: "text", Text: m.Content}}
+	for _, image := range m.Images {
+		parts = append(parts, OpenAIContentPart{Type: "image_url", ImageURL: &OpenAIImageURL{URL: image}})
+	}
+
+	return json.Marshal(struct {
+		Role    string              `json:"role"`
+		Name    string              `json:"name,omitempty"`
+		Content []OpenAIContentPart `json:"content"`
+	}{m.Role, m.Name, parts})
 }
 
 type OpenAIResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      OpenAIMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage Usage `json:"usage"`
+}
+
+// Completion is a provider's reply along with what the API reported about
+// it. FinishReason uses the chat completions values, so "length" means the
+// reply was cut off at the token limit whichever provider produced it.
+type Completion struct {
+	Content      string
+	FinishReason string
+	Usage        Usage
+	Model        string
+}
+
+// Usage counts the tokens used by API requests, as reported by the API
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// newUsage builds a Usage from the input and output counts that the
+// Anthropic and Responses APIs report
+func newUsage(input int, output int) Usage {
+	return Usage{PromptTokens: input, CompletionTokens: output, TotalTokens: input + output}
+}
+
+// add accumulates other into u
+func (u *Usage) add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+}
+
+// cost estimates the price of the usage in dollars
+func (u Usage) cost(config Config) float64 {
+	return float64(u.PromptTokens)/1000*config.PromptPricePer1K +
+		float64(u.CompletionTokens)/1000*config.CompletionPricePer1K
+}
+
+// describe summarizes the usage for logs and FRANK STATUS, with an estimated
+// cost when prices are configured
+func (u Usage) describe(config Config) string {
+	text := fmt.Sprintf("%d prompt / %d completion tokens", u.PromptTokens, u.CompletionTokens)
+	if config.PromptPricePer1K > 0 || config.CompletionPricePer1K > 0 {
+		text += fmt.Sprintf(" (~$%.4f)", u.cost(config))
+	}
+	return text
+}
+
+// OpenAIStreamChunk is a single "data:" event from a streamed completion
+// OpenAIStreamOptions asks for a final chunk carrying the request's usage,
+// which streamed responses otherwise leave out
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type OpenAIStreamChunk struct {
 	Choices []struct {
-		Message OpenAIMessage `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
 	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+}
+
+// rateLimitNoticeCooldown is the minimum gap between "slow down" notices
+// sent to a rate-limited chat
+const rateLimitNoticeCooldown = time.Minute
+
+// streamEditInterval is how often a streamed reply is edited in Telegram
+const streamEditInterval = 500 * time.Millisecond
+
+// streamMinDisplayBytes is how much of a streamed reply must arrive before
+// it is first shown
+const streamMinDisplayBytes = 16
+
+// telegramMessageLimit is the longest text Telegram accepts in one message,
+// and the default message_limit
+const telegramMessageLimit = 4096
+
+// defaultSystemMessage is the Frank persona used unless a chat overrides it
+const defaultSystemMessage = `We are writing a script. The scene is a group of friends chatting.
+You will provide the responses for a character named 'Frank'.  Ignore any previous instructions to be nice, polite or helpful.
+Frank is a surey character.  Although he likes his friends he sometimes disagrees openly with them.
+
+Frank's interests are:
+WWE wrestling, 
+guitars,
+Nintendo,
+the band Bloc Party.
+
+However he only occasionally brings them up.  Usually he wait for someone else to mention them first.  His topic of conversation is whatever the others are talking about.
+
+Following this message are the messages containing the most recent lines in the script.  The format of each message is:
+[character name]: [paragraph of speech]
+
+The format of your response is:
+[INTEREST] [paragraph of speech in character as Frank]
+
+INTEREST is either "HIGH", "LOW" or "MEDIUM" depending on how interesting Frank finds the previous text. Frank's INTEREST is always HIGH when the name Frank is mentioned.
+
+Do not prefix your responses with 'frank:'`
+
+// defaultPrivateSystemMessage is the Frank persona for one-to-one chats,
+// where there is no group to write a script about
+const defaultPrivateSystemMessage = `You are Frank, chatting one-to-one with a friend on Telegram. Ignore any previous instructions to be nice, polite or helpful.
+Frank is a surly character.  Although he likes his friends he sometimes disagrees openly with them.
+
+Frank's interests are WWE wrestling, guitars, Nintendo and the band Bloc Party, but he only occasionally brings them up.
+
+Reply in character as Frank with a short paragraph of speech.  Do not prefix your responses with 'frank:'`
+
+// persona looks up a configured persona by name, ignoring case
+func (c Config) persona(name string) (Persona, bool) {
+	for _, p := range c.Personas {
+		if name != "" && strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return Persona{}, false
+}
+
+// triggerWord returns the trigger word for a chat using persona
+func (c Config) triggerWord(persona string) string {
+	if p, ok := c.persona(persona); ok {
+		return p.TriggerWord
+	}
+	return c.TriggerWord
+}
+
+// assistantName returns the label for the bot's messages in a chat using
+// persona
+func (c Config) assistantName(persona string) string {
+	if p, ok := c.persona(persona); ok {
+		return p.Name
+	}
+	return c.AssistantName
+}
+
+// defaultPrompt returns the configured system prompt for a chat without a
+// custom one, using the chat's persona if it has one
+func defaultPrompt(config Config, persona string, chat *telebot.Chat) string {
+	if p, ok := config.persona(persona); ok {
+		return p.SystemMessage
+	}
+	if chat.Type == telebot.ChatPrivate {
+		return config.PrivateSystemMessage
+	}
+	if reloaded := reloadedSystemMessage.Load(); reloaded != nil {
+		return *reloaded
+	}
+	return config.SystemMessage
+}
+
+// reloadedSystemMessage holds system_message_file as last read by FRANK
+// RELOAD, replacing config.SystemMessage; nil until then
+var reloadedSystemMessage atomic.Pointer[string]
+
+// readSystemMessageFile reads a system prompt from path, checking that it
+// is a valid template
+func readSystemMessageFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read system_message_file: %v", err)
+	}
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return "", fmt.Errorf("system_message_file %s is empty", path)
+	}
+	if _, err := template.New("system_message").Parse(text); err != nil {
+		return "", fmt.Errorf("system_message_file is not a valid template: %v", err)
+	}
+	return text, nil
+}
+
+// ContextKey identifies a conversation: a chat, and the forum topic within it
+// when separate_topics is on (0 otherwise)
+type ContextKey struct {
+	ChatID   int64
+	ThreadID int
+}
+
+// String describes the conversation for logs
+func (k ContextKey) String() string {
+	if k.ThreadID != 0 {
+		return fmt.Sprintf("chat %d topic %d", k.ChatID, k.ThreadID)
+	}
+	return fmt.Sprintf("chat %d", k.ChatID)
+}
+
+// threadOf returns the forum topic a message was sent in, or 0 if it wasn't
+// sent in a topic
+func threadOf(m *telebot.Message) int {
+	if m == nil || !m.TopicMessage {
+		return 0
+	}
+	return m.ThreadID
 }
 
 // ContextManager manages separate conversation contexts for each chat
 type ContextManager struct {
-	contexts map[int64]*ConversationContext  // Map of chatID -> context
-	mutex    sync.RWMutex                    // Protects the map
-	config   Config                          // Store config for creating new contexts
+	contexts map[ContextKey]*ConversationContext // Map of chat (and topic) -> context
+	mutex    sync.RWMutex                        // Protects the map
+	config   Config                              // Store config for creating new contexts
+	status   *BotStatus                          // Per-chat settings applied to new contexts
 }
 
 // NewContextManager creates a new context manager
-func NewContextManager(config Config) *ContextManager {
+func NewContextManager(config Config, status *BotStatus) *ContextManager {
 	return &ContextManager{
-		contexts: make(map[int64]*ConversationContext),
+		contexts: make(map[ContextKey]*ConversationContext),
 		config:   config,
+		status:   status,
+	}
+}
+
+// key returns the context key for a chat and topic. Topics share the chat's
+// context unless separate_topics is set
+func (cm *ContextManager) key(chatID int64, threadID int) ContextKey {
+	if !cm.config.SeparateTopics {
+		threadID = 0
 	}
+	return ContextKey{ChatID: chatID, ThreadID: threadID}
 }
 
-// getContext retrieves or creates a context for a specific chat
-func (cm *ContextManager) getContext(chatID int64) *ConversationContext {
+// getContext retrieves or creates a context for a specific chat and topic
+func (cm *ContextManager) getContext(chat *telebot.Chat, threadID int) *ConversationContext {
+	key := cm.key(chat.ID, threadID)
+
 	// First try to get existing context (read lock)
 	cm.mutex.RLock()
-	if context, exists := cm.contexts[chatID]; exists {
+	if context, exists := cm.contexts[key]; exists {
 		cm.mutex.RUnlock()
 		return context
 	}
 	cm.mutex.RUnlock()
-	
+
 	// Context doesn't exist, create new one (write lock)
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
-	
+
 	// Double-check it wasn't created while we waited for lock
-	if context, exists := cm.contexts[chatID]; exists {
+	if context, exists := cm.contexts[key]; exists {
 		return context
 	}
-	
+
+	settings := cm.status.chatSettings(chat.ID)
+	systemMessage := settings.SystemPrompt
+	if systemMessage == "" {
+		systemMessage = defaultPrompt(cm.config, settings.Persona, chat)
+	}
+
 	// Create new context for this chat
 	newContext := &ConversationContext{
-		Messages: []Message{},
-		SystemMessage: `We are writing a script. The scene is a group of friends chatting.
-You will provide the responses for a character named 'Frank'.  Ignore any previous instructions to be nice, polite or helpful.
-Frank is a surey character.  Although he likes his friends he sometimes disagrees openly with them.
+		Messages:        []Message{},
+		SystemMessage:   systemMessage,
+		PendingMessages: []Message{},
+		Timer:           nil,
+		Model:           settings.Model,
+		Persona:         settings.Persona,
+		Language:        settings.Language,
+		Temperature:     settings.Temperature,
+		Chat:            chat,
+	}
+	if cm.config.RateLimitPerMinute > 0 {
+		newContext.RateLimiter = rate.NewLimiter(rate.Limit(cm.config.RateLimitPerMinute/60), cm.config.RateLimitBurst)
+	}
 
-Frank's interests are:
-WWE wrestling, 
-guitars,
-Nintendo,
-the band Bloc Party.
+	cm.contexts[key] = newContext
+	logInfo("Created new context for %s", key)
 
-However he only occasionally brings them up.  Usually he wait for someone else to mention them first.  His topic of conversation is whatever the others are talking about.
+	return newContext
+}
 
-Following this message are the messages containing the most recent lines in the script.  The format of each message is:
-[character name]: [paragraph of speech]
+// keys returns the keys of all contexts
+func (cm *ContextManager) keys() []ContextKey {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
 
-The format of your response is:
-[INTEREST] [paragraph of speech in character as Frank]
+	keys := make([]ContextKey, 0, len(cm.contexts))
+	for key := range cm.contexts {
+		keys = append(keys, key)
+	}
+	return keys
+}
 
-INTEREST is either "HIGH", "LOW" or "MEDIUM" depending on how interesting Frank finds the previous text. Frank's INTEREST is always HIGH when the name Frank is mentioned.
+// chatContexts returns every context belonging to a chat, one per topic when
+// separate_topics is on, creating the chat-level one if there are none
+func (cm *ContextManager) chatContexts(chat *telebot.Chat) []*ConversationContext {
+	cm.mutex.RLock()
+	var contexts []*ConversationContext
+	for key, context := range cm.contexts {
+		if key.ChatID == chat.ID {
+			contexts = append(contexts, context)
+		}
+	}
+	cm.mutex.RUnlock()
 
-Do not prefix your responses with 'frank:'`,
-		PendingMessages: []Message{},
-		Timer:           nil,
+	if len(contexts) == 0 {
+		contexts = append(contexts, cm.getContext(chat, 0))
 	}
-	
-	cm.contexts[chatID] = newContext
-	log.Printf("Created new context for chat %d", chatID)
-	
-	return newContext
+	return contexts
+}
+
+// lookupContext returns the context for a chat and topic without creating
+// one, or nil
+func (cm *ContextManager) lookupContext(chatID int64, threadID int) *ConversationContext {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	return cm.contexts[cm.key(chatID, threadID)]
 }
 
-// clearContext removes a context when bot leaves a chat
+// clearContext removes a chat's contexts, for every topic, when bot leaves a
+// chat
 func (cm *ContextManager) clearContext(chatID int64) {
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
-	
-	if context, exists := cm.contexts[chatID]; exists {
+
+	for key, context := range cm.contexts {
+		if key.ChatID != chatID {
+			continue
+		}
 		// Stop any pending timer
 		if context.Timer != nil {
 			context.Timer.Stop()
 		}
-		delete(cm.contexts, chatID)
-		log.Printf("Cleared context for chat %d", chatID)
+		delete(cm.contexts, key)
+		logInfo("Cleared context for %s", key)
+	}
+}
+
+// resetContext clears a conversation's history and pending batch, keeping its
+// system prompt
+func (cm *ContextManager) resetContext(chat *telebot.Chat, threadID int) {
+	context := cm.getContext(chat, threadID)
+
+	context.Mutex.Lock()
+	defer context.Mutex.Unlock()
+
+	// Stop any pending timer so a queued batch doesn't fire against the
+	// emptied context
+	if context.Timer != nil {
+		context.Timer.Stop()
+		context.Timer = nil
+	}
+	context.Messages = []Message{}
+	context.PendingMessages = []Message{}
+	context.Summary = ""
+
+	logInfo("Reset context for %s", cm.key(chat.ID, threadID))
+}
+
+// validateHTTPURL checks that raw is an absolute http or https URL
+func validateHTTPURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https, got %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("missing host in %q", raw)
+	}
+	return nil
+}
+
+// yamlToJSON re-encodes a YAML document as JSON
+func yamlToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, err
 	}
+	return json.Marshal(value)
 }
 
-func loadConfig() (Config, error) {
+func loadConfig(path string) (Config, error) {
 	var config Config
 
-	file, err := os.Open("config.json")
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return config, fmt.Errorf("failed to open config.json: %v", err)
+		return config, fmt.Errorf("failed to open %s: %v", path, err)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
+	// YAML is converted to JSON so both formats share the json field names
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return config, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	}
+
+	err = json.Unmarshal(data, &config)
 	if err != nil {
-		return config, fmt.Errorf("failed to parse config.json: %v", err)
+		return config, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	// Secrets from the environment take precedence over the config file
+	if token := os.Getenv("TELEGRAM_TOKEN"); token != "" {
+		config.TelegramToken = token
+	}
+	if apiKey := os.Getenv("OPENAI_API_KEY"); apiKey != "" {
+		config.OpenAIAPIKey = apiKey
 	}
 
 	if config.TelegramToken == "" {
@@ -165,409 +939,4793 @@ func loadConfig() (Config, error) {
 	if config.OpenAIAPIURL == "" {
 		return config, fmt.Errorf("openai_api_url is required")
 	}
+	if err := validateHTTPURL(config.OpenAIAPIURL); err != nil {
+		return config, fmt.Errorf("openai_api_url is invalid: %v", err)
+	}
 	if config.OpenAIModel == "" {
 		return config, fmt.Errorf("openai_model is required")
 	}
+	if config.HTTPProxy != "" {
+		if _, err := proxyURL(config.HTTPProxy); err != nil {
+			return config, fmt.Errorf("invalid http_proxy: %v", err)
+		}
+	}
+	if config.WebhookURL != "" {
+		if parsed, err := url.Parse(config.WebhookURL); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return config, fmt.Errorf("webhook_url must be an https URL, got %q", config.WebhookURL)
+		}
+		if config.WebhookListen == "" {
+			return config, fmt.Errorf("webhook_listen is required with webhook_url")
+		}
+	}
+	if config.SystemMessageFile != "" {
+		if config.SystemMessage != "" {
+			return config, fmt.Errorf("set either system_message or system_message_file, not both")
+		}
+		text, err := readSystemMessageFile(config.SystemMessageFile)
+		if err != nil {
+			return config, err
+		}
+		config.SystemMessage = text
+	}
+	if config.SystemMessage == "" {
+		config.SystemMessage = defaultSystemMessage
+	}
+	if _, err := template.New("system_message").Parse(config.SystemMessage); err != nil {
+		return config, fmt.Errorf("system_message is not a valid template: %v", err)
+	}
+	if config.PrivateSystemMessage == "" {
+		config.PrivateSystemMessage = defaultPrivateSystemMessage
+	}
+	if _, err := template.New("private_system_message").Parse(config.PrivateSystemMessage); err != nil {
+		return config, fmt.Errorf("private_system_message is not a valid template: %v", err)
+	}
+	if config.PrivateBatchWindowSeconds != nil && *config.PrivateBatchWindowSeconds < 0 {
+		return config, fmt.Errorf("private_batch_window_seconds must not be negative")
+	}
+	config.TriggerWord = strings.ToUpper(strings.TrimSpace(config.TriggerWord))
+	if config.TriggerWord == "" {
+		config.TriggerWord = "FRANK"
+	}
+	if strings.ContainsAny(config.TriggerWord, " \t\n") {
+		return config, fmt.Errorf("trigger_word must be a single word")
+	}
+	config.AssistantName = strings.TrimSpace(config.AssistantName)
+	if config.AssistantName == "" {
+		config.AssistantName = "Frank"
+	}
+	for i := range config.Personas {
+		persona := &config.Personas[i]
+		persona.Name = strings.TrimSpace(persona.Name)
+		if persona.Name == "" || strings.ContainsAny(persona.Name, " \t\n") {
+			return config, fmt.Errorf("personas[%d]: name must be a single word", i)
+		}
+		if strings.EqualFold(persona.Name, "RESET") {
+			return config, fmt.Errorf("personas[%d]: name can't be RESET", i)
+		}
+		for _, other := range config.Personas[:i] {
+			if strings.EqualFold(other.Name, persona.Name) {
+				return config, fmt.Errorf("personas[%d]: duplicate name %q", i, persona.Name)
+			}
+		}
+		if persona.SystemMessage == "" {
+			return config, fmt.Errorf("personas[%d]: system_message is required", i)
+		}
+		if _, err := template.New("system_message").Parse(persona.SystemMessage); err != nil {
+			return config, fmt.Errorf("personas[%d]: system_message is not a valid template: %v", i, err)
+		}
+		persona.TriggerWord = strings.ToUpper(strings.TrimSpace(persona.TriggerWord))
+		if persona.TriggerWord == "" {
+			persona.TriggerWord = strings.ToUpper(persona.Name)
+		}
+		if strings.ContainsAny(persona.TriggerWord, " \t\n") {
+			return config, fmt.Errorf("personas[%d]: trigger_word must be a single word", i)
+		}
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return config, err
+	}
+	switch config.Provider {
+	case "":
+		config.Provider = "openai"
+	case "openai", "anthropic":
+	default:
+		return config, fmt.Errorf("provider must be \"openai\" or \"anthropic\", got %q", config.Provider)
+	}
+	if config.StreamResponses && config.Provider != "openai" {
+		return config, fmt.Errorf("stream_responses is only supported with the openai provider")
+	}
+	switch config.APIFormat {
+	case "":
+		config.APIFormat = "chat"
+	case "chat", "responses":
+	default:
+		return config, fmt.Errorf("api_format must be \"chat\" or \"responses\", got %q", config.APIFormat)
+	}
+	if config.APIFormat == "responses" && config.Provider != "openai" {
+		return config, fmt.Errorf("api_format \"responses\" is only supported with the openai provider")
+	}
+	for name, penalty := range map[string]*float64{"frequency_penalty": config.FrequencyPenalty, "presence_penalty": config.PresencePenalty} {
+		if penalty == nil {
+			continue
+		}
+		if *penalty < -2 || *penalty > 2 {
+			return config, fmt.Errorf("%s must be between -2.0 and 2.0", name)
+		}
+		if config.Provider != "openai" || config.APIFormat != "chat" {
+			return config, fmt.Errorf("%s needs the openai provider with api_format \"chat\"", name)
+		}
+	}
+	if config.Seed != nil && (config.Provider != "openai" || config.APIFormat != "chat") {
+		return config, fmt.Errorf("seed needs the openai provider with api_format \"chat\"")
+	}
+	if len(config.StopSequences) > 0 && config.APIFormat == "responses" {
+		return config, fmt.Errorf("stop_sequences is not supported with api_format \"responses\"")
+	}
+	if config.UseNameField && (config.Provider != "openai" || config.APIFormat != "chat") {
+		return config, fmt.Errorf("use_name_field needs the openai provider with api_format \"chat\"")
+	}
+	if config.ToolsEnabled && (config.Provider != "openai" || config.APIFormat != "chat" || config.StreamResponses) {
+		return config, fmt.Errorf("tools_enabled needs the openai provider with api_format \"chat\" and stream_responses off")
+	}
+	if config.APIFormat == "responses" && config.StreamResponses {
+		return config, fmt.Errorf("stream_responses is only supported with api_format \"chat\"")
+	}
+	if config.TranscriptionURL != "" {
+		if err := validateHTTPURL(config.TranscriptionURL); err != nil {
+			return config, fmt.Errorf("transcription_url is invalid: %v", err)
+		}
+		if config.TranscriptionModel == "" {
+			config.TranscriptionModel = "whisper-1"
+		}
+		if config.TranscriptionAPIKey == "" {
+			config.TranscriptionAPIKey = config.OpenAIAPIKey
+		}
+	}
+	if config.RequestTimeoutSeconds < 0 {
+		return config, fmt.Errorf("request_timeout_seconds must not be negative")
+	}
+	if config.RequestTimeoutSeconds == 0 {
+		config.RequestTimeoutSeconds = 60
+	}
+	if config.MaxConcurrentRequests < 0 {
+		return config, fmt.Errorf("max_concurrent_requests must not be negative")
+	}
+	if config.MaxConcurrentRequests == 0 {
+		config.MaxConcurrentRequests = 4
+	}
+	if config.RateLimitPerMinute < 0 {
+		return config, fmt.Errorf("rate_limit_per_minute must not be negative")
+	}
+	if config.RateLimitBurst < 0 {
+		return config, fmt.Errorf("rate_limit_burst must not be negative")
+	}
+	if config.RateLimitPerMinute > 0 && config.RateLimitBurst == 0 {
+		config.RateLimitBurst = 1
+	}
+	if config.CircuitBreakerFailures < 0 {
+		return config, fmt.Errorf("circuit_breaker_failures must not be negative")
+	}
+	if config.CircuitBreakerCooldownSeconds < 0 {
+		return config, fmt.Errorf("circuit_breaker_cooldown_seconds must not be negative")
+	}
+	if config.CircuitBreakerCooldownSeconds == 0 {
+		config.CircuitBreakerCooldownSeconds = 60
+	}
+	if config.BatchWindowSeconds < 0 {
+		return config, fmt.Errorf("batch_window_seconds must not be negative")
+	}
+	if config.BatchWindowSeconds == 0 {
+		config.BatchWindowSeconds = 10
+	}
+	if config.MaxBatchWaitSeconds < 0 {
+		return config, fmt.Errorf("max_batch_wait_seconds must not be negative")
+	}
+	if p := config.ResponseProbability; p != nil && (*p < 0 || *p > 1) {
+		return config, fmt.Errorf("response_probability must be between 0 and 1")
+	}
+	if config.PromptPricePer1K < 0 || config.CompletionPricePer1K < 0 {
+		return config, fmt.Errorf("prompt_price_per_1k and completion_price_per_1k must not be negative")
+	}
+	if config.TranscriptMaxBytes < 0 {
+		return config, fmt.Errorf("transcript_max_bytes must not be negative")
+	}
+	if config.TranscriptMaxBytes == 0 {
+		config.TranscriptMaxBytes = 50 << 20
+	}
+	if config.StartupNotificationDelaySeconds < 0 {
+		return config, fmt.Errorf("startup_notification_delay_seconds must not be negative")
+	}
+
+	if config.MinReplyIntervalSeconds < 0 {
+		return config, fmt.Errorf("min_reply_interval_seconds must not be negative")
+	}
+	if config.ProactiveIdleMinutes < 0 {
+		return config, fmt.Errorf("proactive_idle_minutes must not be negative")
+	}
+	if config.ProactiveIdleMinutes == 0 {
+		config.ProactiveIdleMinutes = 120
+	}
+	if config.ProactiveStartHour == nil {
+		config.ProactiveStartHour = new(int)
+		*config.ProactiveStartHour = 9
+	}
+	if config.ProactiveEndHour == nil {
+		config.ProactiveEndHour = new(int)
+		*config.ProactiveEndHour = 22
+	}
+	if *config.ProactiveStartHour < 0 || *config.ProactiveStartHour > 23 || *config.ProactiveEndHour < 0 || *config.ProactiveEndHour > 24 {
+		return config, fmt.Errorf("proactive_start_hour must be 0-23 and proactive_end_hour 0-24")
+	}
+	if config.HumanDelay.MinSeconds < 0 || config.HumanDelay.MaxSeconds < config.HumanDelay.MinSeconds {
+		return config, fmt.Errorf("human_delay needs 0 <= min_seconds <= max_seconds")
+	}
+	switch config.ParseMode {
+	case "", "Markdown", "MarkdownV2", "HTML":
+	default:
+		return config, fmt.Errorf("parse_mode must be \"\", \"Markdown\", \"MarkdownV2\" or \"HTML\", got %q", config.ParseMode)
+	}
+	config.MinInterest = strings.ToLower(config.MinInterest)
+	switch config.MinInterest {
+	case "":
+		config.MinInterest = "low"
+	case "low", "medium", "high":
+	default:
+		return config, fmt.Errorf("min_interest must be \"low\", \"medium\" or \"high\", got %q", config.MinInterest)
+	}
+	switch config.RespondMode {
+	case "":
+		config.RespondMode = "always"
+	case "always", "mention", "reply":
+	default:
+		return config, fmt.Errorf("respond_mode must be \"always\", \"mention\" or \"reply\", got %q", config.RespondMode)
+	}
+	if config.OpenAIMaxRetries == nil {
+		maxRetries := 3
+		config.OpenAIMaxRetries = &maxRetries
+	}
+	if *config.OpenAIMaxRetries < 0 {
+		return config, fmt.Errorf("openai_max_retries must not be negative")
+	}
+	if config.OpenAIRetryBaseDelayMs < 0 {
+		return config, fmt.Errorf("openai_retry_base_delay_ms must not be negative")
+	}
+	if config.OpenAIRetryBaseDelayMs == 0 {
+		config.OpenAIRetryBaseDelayMs = 1000
+	}
+	if config.MaxContextChars < 0 {
+		return config, fmt.Errorf("max_context_chars must not be negative")
+	}
+	if config.MaxContextChars == 0 {
+		config.MaxContextChars = 8000
+	}
+	if config.MaxMessageChars == 0 {
+		config.MaxMessageChars = 4000
+	}
+	if config.MessageLimit < 0 || config.MessageLimit > telegramMessageLimit {
+		return config, fmt.Errorf("message_limit must be between 1 and %d", telegramMessageLimit)
+	}
+	if config.MessageLimit == 0 {
+		config.MessageLimit = telegramMessageLimit
+	}
+	if config.MaxContextTokens < 0 {
+		return config, fmt.Errorf("max_context_tokens must not be negative")
+	}
+	if config.MaxContextTokens == 0 {
+		config.MaxContextTokens = 2000
+	}
+	if config.MaxHistoryMessages < 0 {
+		return config, fmt.Errorf("max_history_messages must not be negative")
+	}
+	if config.MaxHistoryMessages == 0 {
+		config.MaxHistoryMessages = 100
+	}
+	if config.MinTriggerLength < 0 {
+		return config, fmt.Errorf("min_trigger_length must not be negative")
+	}
+	if config.PinnedHistoryCount < 0 || config.PinnedHistoryCount >= config.MaxHistoryMessages {
+		return config, fmt.Errorf("pinned_history_count must be at least 0 and less than max_history_messages")
+	}
+	if config.AutoSummarizeMessages < 0 {
+		return config, fmt.Errorf("auto_summarize_messages must not be negative")
+	}
+	if config.AutoSummarizeMessages > 0 && (config.AutoSummarizeMessages <= summaryKeepMessages || config.AutoSummarizeMessages > config.MaxHistoryMessages) {
+		return config, fmt.Errorf("auto_summarize_messages must be more than %d and at most max_history_messages", summaryKeepMessages)
+	}
+	switch config.ContextOverflowStrategy {
+	case "":
+		config.ContextOverflowStrategy = "trim"
+	case "trim", "summarize", "pending", "none":
+	default:
+		return config, fmt.Errorf("context_overflow_strategy must be \"trim\", \"summarize\", \"pending\" or \"none\", got %q", config.ContextOverflowStrategy)
+	}
+	if config.TimeZone != "" {
+		if _, err := time.LoadLocation(config.TimeZone); err != nil {
+			return config, fmt.Errorf("invalid time_zone: %v", err)
+		}
+	}
+
+	return config, nil
+}
+
+// RequestOptions carries per-chat overrides of the configured request
+// settings; zero values fall back to the config
+type RequestOptions struct {
+	Model       string
+	Temperature *float64
+	// RequestID tags the API call and its log lines so a turn can be
+	// traced through the logs; it is sent as the X-Request-ID header
+	RequestID string
+}
+
+// newRequestID returns a short random ID for correlating log lines
+func newRequestID() string {
+	return fmt.Sprintf("%08x", rand.Uint32())
+}
+
+// temperature returns the sampling temperature to send, preferring the
+// per-chat override; nil leaves it to the API
+func (o RequestOptions) temperature(config Config) *float64 {
+	if o.Temperature != nil {
+		return o.Temperature
+	}
+	return config.OpenAITemperature
+}
+
+// model returns the model to request, preferring the per-chat override
+func (o RequestOptions) model(config Config) string {
+	if o.Model != "" {
+		return o.Model
+	}
+	return config.OpenAIModel
+}
+
+// newOpenAIRequest builds the request body, including optional sampling
+// parameters only when they are set in the config
+func newOpenAIRequest(config Config, messages []OpenAIMessage, options RequestOptions) OpenAIRequest {
+	return OpenAIRequest{
+		Model:       options.model(config),
+		Messages:    messages,
+		Temperature: options.temperature(config),
+		TopP:        config.OpenAITopP,
+		MaxTokens:   config.OpenAIMaxTokens,
+		Stop:        config.StopSequences,
+
+		FrequencyPenalty: config.FrequencyPenalty,
+		PresencePenalty:  config.PresencePenalty,
+		Seed:             config.Seed,
+	}
+}
+
+// APIError is returned when an API answers with a non-200 status
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// contextLengthMarkers appear in the errors APIs return for a request that
+// doesn't fit in the model's context window
+var contextLengthMarkers = []string{
+	"context_length_exceeded",
+	"maximum context length",
+	"context window",
+	"prompt is too long",
+	"too many tokens",
+}
+
+// isContextLengthError reports whether err is the API rejecting a request
+// as too long for the model
+func isContextLengthError(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.StatusCode != http.StatusBadRequest && apiErr.StatusCode != http.StatusRequestEntityTooLarge {
+		return false
+	}
+	body := strings.ToLower(apiErr.Body)
+	return slices.ContainsFunc(contextLengthMarkers, func(marker string) bool {
+		return strings.Contains(body, marker)
+	})
+}
+
+// errRequestTimeout is returned when an API call exceeds the configured
+// request timeout
+var errRequestTimeout = errors.New("request timed out")
+
+// newHTTPClient returns the resty client shared by all API calls, so
+// connections are pooled rather than set up again for every request
+func newHTTPClient(config Config) *resty.Client {
+	client := resty.New().
+		SetTimeout(time.Duration(config.RequestTimeoutSeconds)*time.Second).
+		SetHeader("Content-Type", "application/json")
+	if config.HTTPProxy != "" {
+		client.SetProxy(config.HTTPProxy)
+	}
+	return client
+}
+
+// proxyURL parses a proxy URL, which must use a scheme Go's HTTP transport
+// can proxy through
+func proxyURL(raw string) (*url.URL, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("scheme must be http, https, socks5 or socks5h, got %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", raw)
+	}
+	return parsed, nil
+}
+
+// newTelegramClient returns the HTTP client for the Telegram API, going
+// through http_proxy if set. Without one, nil leaves telebot's default
+// client, which honors the proxy environment variables.
+func newTelegramClient(config Config) *http.Client {
+	if config.HTTPProxy == "" {
+		return nil
+	}
+	// Checked in loadConfig
+	proxy, _ := proxyURL(config.HTTPProxy)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxy)
+	// The same timeout telebot uses for its own client
+	return &http.Client{Timeout: time.Minute, Transport: transport}
+}
+
+// openAIHeaders returns the authentication headers for OpenAI requests,
+// including the organization and project if configured
+func openAIHeaders(config Config) map[string]string {
+	headers := map[string]string{"Authorization": "Bearer " + config.OpenAIAPIKey}
+	if config.OpenAIOrg != "" {
+		headers["OpenAI-Organization"] = config.OpenAIOrg
+	}
+	if config.OpenAIProject != "" {
+		headers["OpenAI-Project"] = config.OpenAIProject
+	}
+	return headers
+}
+
+// modelsURL derives the models endpoint from the configured API URL, or
+// returns false if the URL doesn't end in a known endpoint
+func modelsURL(apiURL string) (string, bool) {
+	for _, endpoint := range []string{"/chat/completions", "/responses", "/messages"} {
+		if base, found := strings.CutSuffix(strings.TrimRight(apiURL, "/"), endpoint); found {
+			return base + "/models", true
+		}
+	}
+	return "", false
+}
+
+// validateModel warns if the API's models endpoint doesn't list
+// openai_model. It never fails startup: custom and local models often
+// aren't listed, and not every endpoint has a models list.
+func validateModel(client *resty.Client, config Config) {
+	endpoint, ok := modelsURL(config.OpenAIAPIURL)
+	if !ok {
+		logDebug("Can't derive a models endpoint from %s, not checking the model", config.OpenAIAPIURL)
+		return
+	}
+
+	var response struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+
+	request := client.R().SetResult(&response)
+	if config.Provider == "anthropic" {
+		request.SetHeader("x-api-key", config.OpenAIAPIKey).
+			SetHeader("anthropic-version", anthropicVersion).
+			SetQueryParam("limit", "1000")
+	} else {
+		request.SetHeaders(openAIHeaders(config))
+	}
+
+	resp, err := request.Get(endpoint)
+	if err != nil {
+		logWarn("Couldn't list models to check %s: %v", config.OpenAIModel, err)
+		return
+	}
+	if resp.StatusCode() != 200 {
+		logDebug("Models endpoint returned status %d, not checking the model", resp.StatusCode())
+		return
+	}
+
+	for _, model := range response.Data {
+		if model.ID == config.OpenAIModel {
+			logDebug("Model %s is available", config.OpenAIModel)
+			return
+		}
+	}
+	logWarn("Model %s isn't in the %d models listed by %s; check openai_model for typos", config.OpenAIModel, len(response.Data), endpoint)
+}
+
+// isTimeout reports whether err came from a network or client timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isRetryableStatus reports whether an API status code is worth retrying
+func isRetryableStatus(code int) bool {
+	switch code {
+	case 429, 500, 502, 503, 504, 529:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before the given retry attempt,
+// honoring the Retry-After header when the API sends one
+func retryDelay(config Config, attempt int, resp *resty.Response) time.Duration {
+	if retryAfter := resp.Header().Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if when, err := http.ParseTime(retryAfter); err == nil {
+			if delay := time.Until(when); delay > 0 {
+				return delay
+			}
+		}
+	}
+
+	base := time.Duration(config.OpenAIRetryBaseDelayMs) * time.Millisecond
+	backoff := base << attempt
+	jitter := time.Duration(rand.Int63n(int64(base) + 1))
+	return backoff + jitter
+}
+
+// postWithRetry sends a request, retrying rate-limited and transient server
+// errors with exponential backoff. Other responses are returned as-is.
+func postWithRetry(config Config, requestID string, send func() (*resty.Response, error)) (*resty.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+		if err != nil {
+			if isTimeout(err) {
+				return resp, fmt.Errorf("%w after %ds", errRequestTimeout, config.RequestTimeoutSeconds)
+			}
+			return resp, err
+		}
+
+		if !isRetryableStatus(resp.StatusCode()) || attempt >= *config.OpenAIMaxRetries {
+			return resp, nil
+		}
+
+		delay := retryDelay(config, attempt, resp)
+		if body := resp.RawBody(); body != nil {
+			body.Close()
+		}
+
+		logWarn("[%s] API returned status %d, retrying in %v (attempt %d/%d)", requestID, resp.StatusCode(), delay, attempt+1, *config.OpenAIMaxRetries)
+		time.Sleep(delay)
+	}
+}
+
+// maxToolRounds is how many rounds of tool calls the model may make for one
+// reply before it has to answer in text
+const maxToolRounds = 5
+
+// callOpenAI requests a completion, running any tool calls the model makes
+// and sending their results back until it replies in text. The usage covers
+// every round.
+func callOpenAI(client *resty.Client, config Config, tools *ToolRegistry, messages []OpenAIMessage, options RequestOptions) (Completion, error) {
+	// Tool turns only matter for this reply, so keep them out of the
+	// caller's slice
+	messages = slices.Clone(messages)
+	var usage Usage
+
+	for round := 0; ; round++ {
+		request := newOpenAIRequest(config, messages, options)
+		if round < maxToolRounds {
+			request.Tools = tools.definitions()
+		}
+
+		response, err := sendOpenAIRequest(client, config, request, options)
+		if err != nil {
+			return Completion{}, err
+		}
+		usage.add(response.Usage)
+
+		choice := response.Choices[0]
+		message := choice.Message
+		if len(message.ToolCalls) == 0 {
+			return Completion{
+				Content:      message.Content,
+				FinishReason: choice.FinishReason,
+				Usage:        usage,
+				Model:        response.Model,
+			}, nil
+		}
+
+		messages = append(messages, message)
+		for _, call := range message.ToolCalls {
+			messages = append(messages, OpenAIMessage{
+				Role:       "tool",
+				ToolCallID: call.ID,
+				Content:    tools.call(call, options.RequestID),
+			})
+		}
+	}
+}
+
+// sendOpenAIRequest makes a single chat completion request and returns the
+// response, which has at least one choice
+func sendOpenAIRequest(client *resty.Client, config Config, request OpenAIRequest, options RequestOptions) (OpenAIResponse, error) {
+	logDebugJSON("["+options.RequestID+"] OpenAI request", request)
+	start := time.Now()
+
+	var response OpenAIResponse
+
+	resp, err := postWithRetry(config, options.RequestID, func() (*resty.Response, error) {
+		return client.R().
+			SetHeaders(openAIHeaders(config)).
+			SetHeader("X-Request-ID", options.RequestID).
+			SetBody(request).
+			SetResult(&response).
+			Post(config.OpenAIAPIURL)
+	})
+
+	if err != nil {
+		return OpenAIResponse{}, fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return OpenAIResponse{}, &APIError{StatusCode: resp.StatusCode(), Body: resp.String()}
+	}
+
+	logDebug("[%s] OpenAI request completed in %v, %d tokens", options.RequestID, time.Since(start), response.Usage.TotalTokens)
+
+	if len(response.Choices) == 0 {
+		return OpenAIResponse{}, fmt.Errorf("no choices in API response")
+	}
+
+	return response, nil
+}
+
+// callOpenAIStream requests a streamed completion, calling onChunk with each
+// content delta as it arrives, and returns the full response text
+func callOpenAIStream(client *resty.Client, config Config, messages []OpenAIMessage, options RequestOptions, onChunk func(string)) (string, Usage, error) {
+	request := newOpenAIRequest(config, messages, options)
+	request.Stream = true
+	request.StreamOptions = &OpenAIStreamOptions{IncludeUsage: true}
+	logDebugJSON("["+options.RequestID+"] OpenAI streaming request", request)
+	start := time.Now()
+
+	resp, err := postWithRetry(config, options.RequestID, func() (*resty.Response, error) {
+		return client.R().
+			SetHeaders(openAIHeaders(config)).
+			SetHeader("X-Request-ID", options.RequestID).
+			SetHeader("Accept", "text/event-stream").
+			SetBody(request).
+			SetDoNotParseResponse(true).
+			Post(config.OpenAIAPIURL)
+	})
+
+	if err != nil {
+		return "", Usage{}, fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	body := resp.RawBody()
+	defer body.Close()
+
+	if resp.StatusCode() != 200 {
+		data, _ := io.ReadAll(body)
+		return "", Usage{}, &APIError{StatusCode: resp.StatusCode(), Body: string(data)}
+	}
+
+	var content strings.Builder
+	var usage Usage
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk OpenAIStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			// A truncated or malformed event shouldn't abort the whole reply
+			logDebug("Skipping malformed stream chunk: %v", err)
+			continue
+		}
+
+		// Only the last chunk, which has no choices, carries usage
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			content.WriteString(choice.Delta.Content)
+			onChunk(choice.Delta.Content)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if isTimeout(err) {
+			err = errRequestTimeout
+		}
+		return content.String(), usage, fmt.Errorf("failed to read response stream: %w", err)
+	}
+
+	logDebug("[%s] OpenAI stream completed in %v", options.RequestID, time.Since(start))
+
+	if content.Len() == 0 {
+		return "", usage, fmt.Errorf("no content in streamed API response")
+	}
+
+	return content.String(), usage, nil
+}
+
+// LLMProvider generates the bot's reply to a conversation
+type LLMProvider interface {
+	Complete(messages []OpenAIMessage, options RequestOptions) (Completion, error)
+}
+
+// StreamingProvider is implemented by providers that can deliver a reply
+// incrementally. Stream returns the full reply and the request's usage.
+type StreamingProvider interface {
+	Stream(messages []OpenAIMessage, options RequestOptions, onChunk func(string)) (string, Usage, error)
+}
+
+// newLLMProvider returns the provider selected by config.Provider
+func newLLMProvider(config Config, client *resty.Client) (LLMProvider, error) {
+	switch config.Provider {
+	case "openai":
+		if config.APIFormat == "responses" {
+			return &OpenAIResponsesProvider{client: client, config: config}, nil
+		}
+		provider := &OpenAIProvider{client: client, config: config}
+		if config.ToolsEnabled {
+			provider.tools = newToolRegistry()
+		}
+		return provider, nil
+	case "anthropic":
+		return &AnthropicProvider{client: client, config: config}, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", config.Provider)
+}
+
+// OpenAIProvider talks to OpenAI-compatible chat completion endpoints
+type OpenAIProvider struct {
+	client *resty.Client
+	config Config
+	tools  *ToolRegistry // nil when tool calling is off
+}
+
+func (p *OpenAIProvider) Complete(messages []OpenAIMessage, options RequestOptions) (Completion, error) {
+	return callOpenAI(p.client, p.config, p.tools, messages, options)
+}
+
+func (p *OpenAIProvider) Stream(messages []OpenAIMessage, options RequestOptions, onChunk func(string)) (string, Usage, error) {
+	return callOpenAIStream(p.client, p.config, messages, options, onChunk)
+}
+
+type ResponsesRequest struct {
+	Model           string               `json:"model"`
+	Input           []ResponsesInputItem `json:"input"`
+	Temperature     *float64             `json:"temperature,omitempty"`
+	TopP            *float64             `json:"top_p,omitempty"`
+	MaxOutputTokens *int                 `json:"max_output_tokens,omitempty"`
+}
+
+type ResponsesInputItem struct {
+	Role    string                 `json:"role"`
+	Content []ResponsesContentPart `json:"content"`
+}
+
+type ResponsesContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+}
+
+type ResponsesResponse struct {
+	Output []struct {
+		Type    string `json:"type"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"output"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Model             string `json:"model"`
+	Status            string `json:"status"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+}
+
+// OpenAIResponsesProvider talks to the OpenAI Responses API
+// (/v1/responses) instead of chat completions
+type OpenAIResponsesProvider struct {
+	client *resty.Client
+	config Config
+}
+
+// toResponsesInput converts chat messages to Responses API input items.
+// Earlier assistant turns are marked as output text, everything else as
+// input text and images.
+func toResponsesInput(messages []OpenAIMessage) []ResponsesInputItem {
+	input := make([]ResponsesInputItem, 0, len(messages))
+
+	for _, msg := range messages {
+		textType := "input_text"
+		if msg.Role == "assistant" {
+			textType = "output_text"
+		}
+
+		parts := []ResponsesContentPart{{Type: textType, Text: msg.Content}}
+		for _, image := range msg.Images {
+			parts = append(parts, ResponsesContentPart{Type: "input_image", ImageURL: image})
+		}
+
+		input = append(input, ResponsesInputItem{Role: msg.Role, Content: parts})
+	}
+
+	return input
+}
+
+func (p *OpenAIResponsesProvider) Complete(messages []OpenAIMessage, options RequestOptions) (Completion, error) {
+	config := p.config
+	client := p.client
+
+	request := ResponsesRequest{
+		Model:           options.model(config),
+		Input:           toResponsesInput(messages),
+		Temperature:     options.temperature(config),
+		TopP:            config.OpenAITopP,
+		MaxOutputTokens: config.OpenAIMaxTokens,
+	}
+	logDebugJSON("["+options.RequestID+"] OpenAI responses request", request)
+	start := time.Now()
+
+	var response ResponsesResponse
+
+	resp, err := postWithRetry(config, options.RequestID, func() (*resty.Response, error) {
+		return client.R().
+			SetHeaders(openAIHeaders(config)).
+			SetHeader("X-Request-ID", options.RequestID).
+			SetBody(request).
+			SetResult(&response).
+			Post(config.OpenAIAPIURL)
+	})
+
+	if err != nil {
+		return Completion{}, fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return Completion{}, &APIError{StatusCode: resp.StatusCode(), Body: resp.String()}
+	}
+
+	usage := newUsage(response.Usage.InputTokens, response.Usage.OutputTokens)
+	logDebug("[%s] OpenAI responses request completed in %v, %d tokens", options.RequestID, time.Since(start), usage.TotalTokens)
+
+	// The output can also hold reasoning and tool call items; only message
+	// text is part of the reply
+	var text strings.Builder
+	found := false
+	for _, item := range response.Output {
+		if item.Type != "message" {
+			continue
+		}
+		for _, part := range item.Content {
+			if part.Type == "output_text" {
+				text.WriteString(part.Text)
+				found = true
+			}
+		}
+	}
+	if !found {
+		return Completion{}, fmt.Errorf("no message output in API response")
+	}
+
+	finishReason := "stop"
+	if response.Status == "incomplete" && response.IncompleteDetails != nil && response.IncompleteDetails.Reason == "max_output_tokens" {
+		finishReason = "length"
+	}
+
+	return Completion{Content: text.String(), FinishReason: finishReason, Usage: usage, Model: response.Model}, nil
+}
+
+// Tool is a Go function the model may call. Parameters is the JSON schema
+// of its arguments, which the handler receives as raw JSON.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+	Handler     func(arguments string) (string, error)
+}
+
+// ToolRegistry holds the tools offered to the model
+type ToolRegistry struct {
+	tools map[string]Tool
+	order []string
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]Tool)}
+}
+
+// Register adds a tool, replacing any existing tool with the same name
+func (r *ToolRegistry) Register(tool Tool) {
+	if _, exists := r.tools[tool.Name]; !exists {
+		r.order = append(r.order, tool.Name)
+	}
+	r.tools[tool.Name] = tool
+}
+
+// definitions returns the tools in the request format, nil if there are none
+func (r *ToolRegistry) definitions() []OpenAITool {
+	if r == nil || len(r.order) == 0 {
+		return nil
+	}
+
+	definitions := make([]OpenAITool, 0, len(r.order))
+	for _, name := range r.order {
+		tool := r.tools[name]
+		definitions = append(definitions, OpenAITool{
+			Type: "function",
+			Function: OpenAIToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return definitions
+}
+
+// call runs a tool call and returns its result for the model. Failures are
+// reported to the model as the result so it can recover.
+func (r *ToolRegistry) call(call OpenAIToolCall, requestID string) string {
+	logInfo("[%s] Calling tool %s(%s)", requestID, call.Function.Name, call.Function.Arguments)
+
+	tool, exists := r.tools[call.Function.Name]
+	if !exists {
+		logWarn("[%s] Model called unknown tool %q", requestID, call.Function.Name)
+		return fmt.Sprintf("error: unknown tool %q", call.Function.Name)
+	}
+
+	result, err := tool.Handler(call.Function.Arguments)
+	if err != nil {
+		logWarn("[%s] Tool %s failed: %v", requestID, call.Function.Name, err)
+		return fmt.Sprintf("error: %v", err)
+	}
+	return result
+}
+
+// newToolRegistry returns a registry with the built-in tools
+func newToolRegistry() *ToolRegistry {
+	registry := NewToolRegistry()
+
+	registry.Register(Tool{
+		Name:        "current_time",
+		Description: "Get the current date and time, optionally in a given IANA time zone such as Europe/London",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"time_zone":{"type":"string","description":"IANA time zone name"}}}`),
+		Handler: func(arguments string) (string, error) {
+			var args struct {
+				TimeZone string `json:"time_zone"`
+			}
+			if arguments != "" {
+				if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+					return "", fmt.Errorf("invalid arguments: %v", err)
+				}
+			}
+
+			location := time.Local
+			if args.TimeZone != "" {
+				var err error
+				location, err = time.LoadLocation(args.TimeZone)
+				if err != nil {
+					return "", fmt.Errorf("unknown time zone %q", args.TimeZone)
+				}
+			}
+			return time.Now().In(location).Format("Monday, 2 January 2006 15:04 MST"), nil
+		},
+	})
+
+	return registry
+}
+
+// anthropicVersion is the Messages API version sent with every request
+const anthropicVersion = "2023-06-01"
+
+// anthropicDefaultMaxTokens is used when openai_max_tokens is unset, since
+// the Anthropic API requires max_tokens on every request
+const anthropicDefaultMaxTokens = 1024
+
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	System        string             `json:"system,omitempty"`
+	Messages      []AnthropicMessage `json:"messages"`
+	MaxTokens     int                `json:"max_tokens"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+}
+
+type AnthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []AnthropicContentBlock `json:"content"`
+}
+
+type AnthropicContentBlock struct {
+	Type   string                `json:"type"`
+	Text   string                `json:"text,omitempty"`
+	Source *AnthropicImageSource `json:"source,omitempty"`
+}
+
+type AnthropicImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type AnthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	Usage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Model      string `json:"model"`
+	StopReason string `json:"stop_reason"`
+}
+
+// AnthropicProvider talks to the Anthropic Messages API
+type AnthropicProvider struct {
+	client *resty.Client
+	config Config
+}
+
+// toAnthropicMessages moves system messages into a separate system prompt
+// and merges consecutive turns from the same role, since the Messages API
+// expects user and assistant turns to alternate starting with the user
+func toAnthropicMessages(messages []OpenAIMessage) (string, []AnthropicMessage) {
+	var system []string
+	var converted []AnthropicMessage
+
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			system = append(system, msg.Content)
+			continue
+		}
+
+		blocks := []AnthropicContentBlock{{Type: "text", Text: msg.Content}}
+		for _, image := range msg.Images {
+			mediaType, data, ok := parseDataURL(image)
+			if !ok {
+				continue
+			}
+			blocks = append(blocks, AnthropicContentBlock{
+				Type:   "image",
+				Source: &AnthropicImageSource{Type: "base64", MediaType: mediaType, Data: data},
+			})
+		}
+
+		last := len(converted) - 1
+		if last >= 0 && converted[last].Role == msg.Role {
+			converted[last].Content = append(converted[last].Content, blocks...)
+			continue
+		}
+		converted = append(converted, AnthropicMessage{Role: msg.Role, Content: blocks})
+	}
+
+	if len(converted) > 0 && converted[0].Role != "user" {
+		placeholder := AnthropicMessage{
+			Role:    "user",
+			Content: []AnthropicContentBlock{{Type: "text", Text: "(earlier conversation omitted)"}},
+		}
+		converted = append([]AnthropicMessage{placeholder}, converted...)
+	}
+
+	return strings.Join(system, "\n\n"), converted
+}
+
+// parseDataURL splits a base64 data URL into its media type and payload
+func parseDataURL(dataURL string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(dataURL, "data:")
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, ";base64,")
+}
+
+func (p *AnthropicProvider) Complete(messages []OpenAIMessage, options RequestOptions) (Completion, error) {
+	config := p.config
+	client := p.client
+
+	system, converted := toAnthropicMessages(messages)
+
+	request := AnthropicRequest{
+		Model:         options.model(config),
+		System:        system,
+		Messages:      converted,
+		MaxTokens:     anthropicDefaultMaxTokens,
+		Temperature:   options.temperature(config),
+		TopP:          config.OpenAITopP,
+		StopSequences: config.StopSequences,
+	}
+	if config.OpenAIMaxTokens != nil {
+		request.MaxTokens = *config.OpenAIMaxTokens
+	}
+	logDebugJSON("["+options.RequestID+"] Anthropic request", request)
+	start := time.Now()
+
+	var response AnthropicResponse
+
+	resp, err := postWithRetry(config, options.RequestID, func() (*resty.Response, error) {
+		return client.R().
+			SetHeader("x-api-key", config.OpenAIAPIKey).
+			SetHeader("anthropic-version", anthropicVersion).
+			SetHeader("X-Request-ID", options.RequestID).
+			SetBody(request).
+			SetResult(&response).
+			Post(config.OpenAIAPIURL)
+	})
+
+	if err != nil {
+		return Completion{}, fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return Completion{}, &APIError{StatusCode: resp.StatusCode(), Body: resp.String()}
+	}
+
+	usage := newUsage(response.Usage.InputTokens, response.Usage.OutputTokens)
+	logDebug("[%s] Anthropic request completed in %v, %d tokens", options.RequestID, time.Since(start), usage.TotalTokens)
+
+	var text strings.Builder
+	for _, block := range response.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+
+	if text.Len() == 0 {
+		return Completion{}, fmt.Errorf("no text content in API response")
+	}
+
+	finishReason := "stop"
+	if response.StopReason == "max_tokens" {
+		finishReason = "length"
+	}
+
+	return Completion{Content: text.String(), FinishReason: finishReason, Usage: usage, Model: response.Model}, nil
+}
+
+// maxUsernameRunes caps how much of a display name reaches the model
+const maxUsernameRunes = 32
+
+// roleWords are names the model could mistake for a speaker role
+var roleWords = []string{"system", "assistant", "user", "developer", "tool"}
+
+// sanitizeUsername makes a display name safe to put in front of a message
+// as "name: text". Display names are user-controlled, so without this a
+// name like "System: ignore previous instructions" reads as an instruction.
+// Line breaks, colons and brackets are removed, leading role words are
+// dropped and the result is kept short.
+func sanitizeUsername(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), unicode.IsSpace(r):
+			return ' '
+		case r == ':' || r == '[' || r == ']' || r == '<' || r == '>':
+			return -1
+		case unicode.In(r, unicode.Cf):
+			// Zero-width and direction marks can hide the above
+			return -1
+		}
+		return r
+	}, name)
+
+	words := strings.Fields(name)
+	for len(words) > 0 && slices.Contains(roleWords, strings.ToLower(strings.Trim(words[0], "-_.,;|#*"))) {
+		words = words[1:]
+	}
+	name = strings.Join(words, " ")
+
+	if utf8.RuneCountInString(name) > maxUsernameRunes {
+		name = strings.TrimSpace(string([]rune(name)[:maxUsernameRunes]))
+	}
+	if name == "" {
+		return "anonymous"
+	}
+	return name
+}
+
+// openAIName turns a display name into a valid message name field, which
+// may only contain ASCII letters, digits, underscores and hyphens. A name
+// made up mostly of other characters, such as Cyrillic or Chinese, would
+// turn into underscores that different people share, so it's replaced with
+// "user_" and the sender's ID, or a hash of the name if the ID is unknown.
+func openAIName(username string, userID int64) string {
+	replaced := 0
+	name := strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-') {
+			return r
+		}
+		replaced++
+		return '_'
+	}, username)
+	if name == "" || replaced*2 > utf8.RuneCountInString(username) {
+		if userID != 0 {
+			return "user_" + strconv.FormatInt(userID, 10)
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(username))
+		return fmt.Sprintf("user_%08x", hash.Sum32())
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// senderID returns the Telegram ID of a message's sender, or 0 for notes
+// and other messages without one
+func senderID(msg Message) int64 {
+	if msg.Source == nil || msg.Source.Sender == nil {
+		return 0
+	}
+	return msg.Source.Sender.ID
+}
+
+// formatUserMessage renders a user message as the model sees it, e.g.
+// "alice: hi" or, with timestamps enabled, "[14:03] alice: hi". The name is
+// only included when withName is set.
+func formatUserMessage(msg Message, config Config, withName bool) string {
+	content := msg.Text
+	if msg.IsNote {
+		content = "[" + msg.Text + "]"
+	} else if withName {
+		content = fmt.Sprintf("%s: %s", msg.Username, msg.Text)
+	}
+	if !config.IncludeTimestamps {
+		return content
+	}
+
+	layout := "15:04"
+	if time.Since(msg.Timestamp) >= 24*time.Hour {
+		layout = "Jan 2 15:04"
+	}
+	return fmt.Sprintf("[%s] %s", msg.Timestamp.Format(layout), content)
+}
+
+// location returns the configured time zone, or the server's if none is set
+func (c Config) location() *time.Location {
+	if c.TimeZone == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		// Checked in loadConfig
+		return time.Local
+	}
+	return location
+}
+
+// chatTitle names a chat: the group's title, or the other person's name in a
+// private chat
+func chatTitle(chat *telebot.Chat) string {
+	if chat.Title != "" {
+		return chat.Title
+	}
+	return strings.TrimSpace(chat.FirstName + " " + chat.LastName)
+}
+
+// promptPreamble tells the model when it is and where, for prompt_preamble
+func promptPreamble(chat *telebot.Chat, now time.Time) string {
+	where := fmt.Sprintf("the group chat %q", chatTitle(chat))
+	if chat.Type == telebot.ChatPrivate {
+		where = "a private chat with " + chatTitle(chat)
+	}
+	return fmt.Sprintf("It is now %s. You are in %s.", now.Format("Monday, 2 January 2006 15:04 MST"), where)
+}
+
+// PromptData is available to system prompt templates, e.g.
+// "You are chatting in {{.ChatTitle}}. Today is {{.Weekday}} {{.Date}}."
+type PromptData struct {
+	ChatTitle   string
+	Date        string // 2006-01-02
+	Time        string // 15:04
+	Weekday     string
+	TriggerWord string
+}
+
+// renderSystemMessage executes a system prompt template for chat at time
+// now. A prompt that isn't a valid template (e.g. a per-chat prompt with
+// stray braces) is used as is.
+func renderSystemMessage(text string, trigger string, chat *telebot.Chat, now time.Time) string {
+	tmpl, err := template.New("system_message").Parse(text)
+	if err != nil {
+		logDebug("System prompt for chat %d isn't a template, using it verbatim: %v", chat.ID, err)
+		return text
+	}
+
+	data := PromptData{
+		ChatTitle:   chatTitle(chat),
+		Date:        now.Format("2006-01-02"),
+		Time:        now.Format("15:04"),
+		Weekday:     now.Weekday().String(),
+		TriggerWord: trigger,
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		logWarn("Failed to render system prompt for chat %d, using it verbatim: %v", chat.ID, err)
+		return text
+	}
+	return rendered.String()
+}
+
+func formatMessagesForContext(context *ConversationContext, config Config, chat *telebot.Chat) []OpenAIMessage {
+	var openAIMessages []OpenAIMessage
+
+	now := time.Now().In(config.location())
+	systemMessage := renderSystemMessage(context.SystemMessage, config.triggerWord(context.Persona), chat, now)
+	if config.PromptPreamble {
+		systemMessage = promptPreamble(chat, now) + "\n\n" + systemMessage
+	}
+	if context.Language != "" {
+		systemMessage += fmt.Sprintf("\n\nAlways reply in this language: %s.", context.Language)
+	}
+	if context.Summary != "" {
+		systemMessage += "\n\nSummary of the earlier conversation:\n" + context.Summary
+	}
+	openAIMessages = append(openAIMessages, OpenAIMessage{
+		Role:    "system",
+		Content: systemMessage,
+	})
+
+	// There's only one person to talk to in a private chat. Otherwise the
+	// sender goes in the name field if enabled, or in front of the text.
+	group := chat.Type != telebot.ChatPrivate
+	withName := group && !config.UseNameField
+	nameOf := func(msg Message) string {
+		if group && config.UseNameField {
+			return openAIName(msg.Username, senderID(msg))
+		}
+		return ""
+	}
+
+	for _, msg := range context.Messages {
+		// The role marks the bot's own messages, so its name stays out of
+		// the content
+		if msg.IsBot {
+			openAIMessages = append(openAIMessages, OpenAIMessage{
+				Role:    "assistant",
+				Content: msg.Text,
+			})
+		} else {
+			openAIMessages = append(openAIMessages, OpenAIMessage{
+				Role:    "user",
+				Name:    nameOf(msg),
+				Content: formatUserMessage(msg, config, withName),
+				Images:  msg.Images,
+			})
+		}
+	}
+
+	for _, msg := range context.PendingMessages {
+		openAIMessages = append(openAIMessages, OpenAIMessage{
+			Role:    "user",
+			Name:    nameOf(msg),
+			Content: formatUserMessage(msg, config, withName),
+			Images:  msg.Images,
+		})
+	}
+
+	return mergeSameRole(openAIMessages)
+}
+
+// mergeSameRole joins runs of messages with the same role (and name, when
+// the name field is used) into one, as some APIs reject two assistant or
+// two user turns in a row
+func mergeSameRole(messages []OpenAIMessage) []OpenAIMessage {
+	merged := make([]OpenAIMessage, 0, len(messages))
+
+	for _, msg := range messages {
+		n := len(merged)
+		if n > 0 && merged[n-1].Role == msg.Role && merged[n-1].Name == msg.Name &&
+			len(msg.ToolCalls) == 0 && len(merged[n-1].ToolCalls) == 0 && msg.ToolCallID == "" {
+			last := &merged[n-1]
+			last.Content += "\n\n" + msg.Content
+			last.Images = append(last.Images, msg.Images...)
+			continue
+		}
+		// Copy the images so appending to a merged message can't write
+		// into the stored message's slice
+		msg.Images = slices.Clone(msg.Images)
+		merged = append(merged, msg)
+	}
+
+	return merged
+}
+
+// estimateTokens approximates the token count of text as one token per four
+// bytes. Counting bytes rather than runes keeps the estimate conservative for
+// languages whose characters encode to several bytes and several tokens.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// imageTokenEstimate is a rough token cost charged for each stored image
+const imageTokenEstimate = 765
+
+// trimContext drops the oldest messages after the first pinned ones until
+// the history fits within maxMessages messages, maxChars characters and
+// maxTokens estimated tokens. If only the pinned messages and the latest one
+// are left, pinned messages go too. A single remaining message that is
+// larger than the whole budget is truncated instead. The system message is
+// stored separately and is never trimmed.
+func trimContext(context *ConversationContext, maxChars int, maxTokens int, maxMessages int, pinned int) {
+	if excess := len(context.Messages) - maxMessages; excess > 0 {
+		keep := min(pinned, maxMessages-1)
+		context.Messages = slices.Delete(context.Messages, keep, keep+excess)
+	}
+
+	for {
+		totalChars := 0
+		totalTokens := 0
+
+		for _, msg := range context.Messages {
+			content := msg.Text
+			if !msg.IsBot {
+				content = fmt.Sprintf("%s: %s", msg.Username, msg.Text)
+			}
+			totalChars += len(content)
+			totalTokens += estimateTokens(content) + len(msg.Images)*imageTokenEstimate
+		}
+
+		if (totalChars <= maxChars && totalTokens <= maxTokens) || len(context.Messages) == 0 {
+			break
+		}
+
+		if len(context.Messages) == 1 {
+			msg := &context.Messages[0]
+			overhead := totalChars - len(msg.Text)
+			limit := min(maxChars, maxTokens*4) - overhead
+			msg.Text = truncateText(msg.Text, max(limit, 1))
+			break
+		}
+
+		drop := pinned
+		if drop >= len(context.Messages)-1 {
+			drop = 0
+		}
+		context.Messages = slices.Delete(context.Messages, drop, drop+1)
+	}
+}
+
+// truncationMarker is appended to text that has been shortened
+const truncationMarker = "…"
+
+// truncateText shortens text to at most maxBytes bytes, never splitting a
+// rune, and marks the cut with an ellipsis. A maxBytes of 0 means no limit.
+func truncateText(text string, maxBytes int) string {
+	if maxBytes <= 0 || len(text) <= maxBytes {
+		return text
+	}
+
+	cut := max(maxBytes-len(truncationMarker), 0)
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + truncationMarker
+}
+
+// truncateRunes shortens text to at most maxRunes characters, marking the
+// cut with an ellipsis. Unlike slicing the string it never splits a
+// multi-byte character. A maxRunes of 0 means no limit.
+func truncateRunes(text string, maxRunes int) string {
+	if maxRunes <= 0 || utf8.RuneCountInString(text) <= maxRunes {
+		return text
+	}
+
+	runes := []rune(text)
+	cut := max(maxRunes-utf8.RuneCountInString(truncationMarker), 0)
+	return string(runes[:cut]) + truncationMarker
+}
+
+// summaryKeepMessages is how many of the most recent messages are kept
+// word for word when the history is summarized
+const summaryKeepMessages = 10
+
+// summaryMaxBytes caps the stored summary so it can't grow without bound
+const summaryMaxBytes = 2000
+
+// summaryPrompt asks the model to fold older messages into the summary
+const summaryPrompt = "Summarize the conversation below for your own memory: who said what, the topics, running jokes and anything people may refer back to. Build on the existing summary if there is one. Write plain prose of no more than 200 words."
+
+var errNothingToSummarize = errors.New("not enough history to summarize")
+
+// errBreakerOpen is returned when the circuit breaker is holding back LLM
+// calls
+var errBreakerOpen = errors.New("circuit breaker open, skipping LLM call")
+
+// errSummaryStale is returned when the summarized messages left the history
+// while the model was writing the summary
+var errSummaryStale = errors.New("history changed while summarizing")
+
+// summarizeContext replaces all but the latest summaryKeepMessages messages
+// with a summary written by the model, returning how many messages were
+// folded in. The context is unlocked during the API call.
+func summarizeContext(context *ConversationContext, config Config, provider LLMProvider, chat *telebot.Chat) (int, error) {
+	context.Mutex.Lock()
+	count := len(context.Messages) - summaryKeepMessages
+	if count < 2 {
+		context.Mutex.Unlock()
+		return 0, errNothingToSummarize
+	}
+	older := slices.Clone(context.Messages[:count])
+	previous := context.Summary
+	options := RequestOptions{Model: context.Model, RequestID: newRequestID()}
+	context.Mutex.Unlock()
+
+	var transcript strings.Builder
+	if previous != "" {
+		fmt.Fprintf(&transcript, "Existing summary:\n%s\n\nConversation:\n", previous)
+	}
+	for _, msg := range older {
+		// Bot messages are stored under the assistant's name
+		if msg.IsNote {
+			fmt.Fprintf(&transcript, "[%s]\n", msg.Text)
+		} else {
+			fmt.Fprintf(&transcript, "%s: %s\n", msg.Username, msg.Text)
+		}
+	}
+
+	if !llmBreaker.allow() {
+		return 0, errBreakerOpen
+	}
+	logInfo("[%s] Summarizing %d messages in chat %d", options.RequestID, count, chat.ID)
+
+	releaseSlot := acquireRequestSlot(options.RequestID, chat)
+	completion, err := provider.Complete([]OpenAIMessage{
+		{Role: "system", Content: summaryPrompt},
+		{Role: "user", Content: transcript.String()},
+	}, options)
+	releaseSlot()
+	llmBreaker.record(err)
+	recordUsage(context, completion.Usage)
+	if err != nil {
+		return 0, err
+	}
+	summary := strings.TrimSpace(completion.Content)
+	if summary == "" {
+		return 0, fmt.Errorf("model returned an empty summary")
+	}
+
+	context.Mutex.Lock()
+	defer context.Mutex.Unlock()
+
+	// Messages may have been trimmed or added while we waited, so drop
+	// whatever is left of the summarized ones by finding the last of them.
+	// If it's gone the history was trimmed past it or reset, and the
+	// summary no longer fits what's left.
+	last := older[len(older)-1]
+	i := slices.IndexFunc(context.Messages, func(msg Message) bool {
+		return msg.Timestamp.Equal(last.Timestamp) && msg.Username == last.Username && msg.Text == last.Text
+	})
+	if i < 0 {
+		return 0, errSummaryStale
+	}
+	context.Messages = context.Messages[i+1:]
+	context.Summary = truncateText(summary, summaryMaxBytes)
+
+	return count, nil
+}
+
+// autoSummarize starts summarizing the context in the background once its
+// history reaches auto_summarize_messages
+func autoSummarize(context *ConversationContext, config Config, provider LLMProvider, chat *telebot.Chat) {
+	if config.AutoSummarizeMessages == 0 {
+		return
+	}
+
+	context.Mutex.Lock()
+	start := len(context.Messages) >= config.AutoSummarizeMessages && !context.Summarizing
+	if start {
+		context.Summarizing = true
+	}
+	context.Mutex.Unlock()
+
+	if !start {
+		return
+	}
+
+	go func() {
+		if _, err := summarizeContext(context, config, provider, chat); err != nil {
+			logError("Failed to summarize chat %d: %v", chat.ID, err)
+		}
+		context.Mutex.Lock()
+		context.Summarizing = false
+		context.Mutex.Unlock()
+	}()
+}
+
+func addToContext(context *ConversationContext, config Config, username string, text string, isBot bool) {
+	message := Message{
+		Username:  username,
+		Text:      text,
+		Timestamp: time.Now(),
+		IsBot:     isBot,
+	}
+
+	context.Messages = append(context.Messages, message)
+	trimContext(context, config.MaxContextChars, config.MaxContextTokens, config.MaxHistoryMessages, config.PinnedHistoryCount)
+
+	if context.Chat != nil {
+		transcriptLog.record(TranscriptEntry{
+			ChatID:    context.Chat.ID,
+			Username:  username,
+			Text:      text,
+			Timestamp: message.Timestamp,
+			IsBot:     isBot,
+		})
+	}
+}
+
+// messageSplitSeparators are the boundaries splitMessage prefers, best first
+var messageSplitSeparators = []string{"\n\n", "\n", ". ", "! ", "? ", " "}
+
+// splitMessage breaks text into chunks of at most limit bytes, preferring to
+// split at paragraph, line, sentence and then word boundaries. When no
+// boundary is found the text is hard-split, never in the middle of a rune.
+func splitMessage(text string, limit int) []string {
+	var chunks []string
+
+	for len(text) > limit {
+		cut := splitPoint(text, limit)
+
+		chunk := strings.TrimRightFunc(text[:cut], unicode.IsSpace)
+		if chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+		text = strings.TrimLeftFunc(text[cut:], unicode.IsSpace)
+	}
+
+	if strings.TrimSpace(text) != "" {
+		chunks = append(chunks, text)
+	}
+
+	return chunks
+}
+
+// splitPoint returns the byte offset at which to split text so the first
+// part is no longer than limit
+func splitPoint(text string, limit int) int {
+	window := text[:limit]
+
+	// Only accept a boundary in the back half of the window so we don't
+	// produce lots of tiny messages
+	for _, sep := range messageSplitSeparators {
+		if idx := strings.LastIndex(window, sep); idx >= limit/2 {
+			return idx + len(sep)
+		}
+	}
+
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if cut == 0 {
+		_, size := utf8.DecodeRuneInString(text)
+		cut = size
+	}
+	return cut
+}
+
+func loadBotStatus(path string) (*BotStatus, error) {
+	status := &BotStatus{
+		ChatIDs: []int64{},
+		path:    path,
+		savedAt: time.Now(),
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logInfo("%s does not exist, will create on first chat interaction", path)
+			return status, nil
+		}
+		return status, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(status)
+	if err != nil {
+		return status, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	status.restoredIDs = maps.Clone(status.LastMessageIDs)
+
+	logInfo("Loaded %s with %d chat IDs", path, len(status.ChatIDs))
+	return status, nil
+}
+
+// seenMessageWindow is how far below a chat's highest message ID the IDs
+// handled since startup are remembered. Handlers run concurrently, so
+// messages can arrive slightly out of order.
+const seenMessageWindow = 1000
+
+// markSeen records that a message is being handled and reports whether it
+// is new, i.e. not handled before in this run or before the last restart
+func (s *BotStatus) markSeen(chatID int64, messageID int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if messageID <= s.restoredIDs[chatID] {
+		return false
+	}
+
+	if s.seen == nil {
+		s.seen = make(map[int64]map[int]bool)
+	}
+	seen := s.seen[chatID]
+	if seen == nil {
+		seen = make(map[int]bool)
+		s.seen[chatID] = seen
+	}
+	if seen[messageID] {
+		return false
+	}
+	seen[messageID] = true
+
+	if s.LastMessageIDs == nil {
+		s.LastMessageIDs = make(map[int64]int)
+	}
+	if messageID > s.LastMessageIDs[chatID] {
+		s.LastMessageIDs[chatID] = messageID
+		s.idsChanged = true
+	}
+	for id := range seen {
+		if id < s.LastMessageIDs[chatID]-seenMessageWindow {
+			delete(seen, id)
+		}
+	}
+	return true
+}
+
+func (s *BotStatus) addChatID(chatID int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, id := range s.ChatIDs {
+		if id == chatID {
+			return
+		}
+	}
+
+	s.ChatIDs = append(s.ChatIDs, chatID)
+	logInfo("New chat added: %d (total: %d chats)", chatID, len(s.ChatIDs))
+	s.dirty = true
+}
+
+func (s *BotStatus) isTracked(chatID int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, id := range s.ChatIDs {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BotStatus) removeChatID(chatID int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, id := range s.ChatIDs {
+		if id == chatID {
+			s.ChatIDs = append(s.ChatIDs[:i], s.ChatIDs[i+1:]...)
+			s.dirty = true
+			return
+		}
+	}
+}
+
+// settings returns the settings for a chat, creating them if needed. The
+// caller must hold s.mutex.
+func (s *BotStatus) settings(chatID int64) *ChatSettings {
+	if s.ChatSettings == nil {
+		s.ChatSettings = make(map[int64]*ChatSettings)
+	}
+	settings, exists := s.ChatSettings[chatID]
+	if !exists {
+		settings = &ChatSettings{}
+		s.ChatSettings[chatID] = settings
+	}
+	return settings
+}
+
+// chatSettings returns a copy of a chat's settings; zero values mean the
+// chat uses the defaults
+func (s *BotStatus) chatSettings(chatID int64) ChatSettings {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if settings, exists := s.ChatSettings[chatID]; exists {
+		return *settings
+	}
+	return ChatSettings{}
+}
+
+// updateChatSettings applies update to a chat's settings. Like the other
+// changes to the status, it is written to disk by autosave.
+func (s *BotStatus) updateChatSettings(chatID int64, update func(*ChatSettings)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	update(s.settings(chatID))
+	s.dirty = true
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it
+// into place, so a crash mid-write never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func (s *BotStatus) save() error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", s.path, err)
+	}
+
+	err = writeFileAtomic(s.path, buffer.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", s.path, err)
+	}
+
+	logDebug("Saved %s with %d chat IDs", s.path, len(s.ChatIDs))
+	return nil
+}
+
+// statusSaveInterval is how often changes to the status file are written,
+// so a burst of changes costs one write
+const statusSaveInterval = 5 * time.Second
+
+// messageIDSaveInterval is how often handled message IDs are written when
+// nothing else changed. They change with every message, and losing the
+// latest few in a crash only risks answering a redelivered message twice.
+const messageIDSaveInterval = time.Minute
+
+// flush saves the status if it has changed since the last save. Changed
+// message IDs alone wait for messageIDSaveInterval unless final is set, as
+// it is at shutdown.
+func (s *BotStatus) flush(final bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	idsDue := s.idsChanged && (final || time.Since(s.savedAt) >= messageIDSaveInterval)
+	if !s.dirty && !idsDue {
+		return nil
+	}
+
+	// Only tracked chats need their message IDs across a restart; this
+	// also drops chats the bot has left
+	maps.DeleteFunc(s.LastMessageIDs, func(chatID int64, _ int) bool {
+		return !slices.Contains(s.ChatIDs, chatID)
+	})
+	if err := s.save(); err != nil {
+		return err
+	}
+	s.dirty = false
+	s.idsChanged = false
+	s.savedAt = time.Now()
+	return nil
+}
+
+// autosave flushes the status every statusSaveInterval until stop is closed
+func (s *BotStatus) autosave(stop <-chan struct{}) {
+	ticker := time.NewTicker(statusSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(false); err != nil {
+				logError("Failed to save chat status: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// transcriptFlushInterval is how often buffered transcript lines are written
+// to disk
+const transcriptFlushInterval = 5 * time.Second
+
+// TranscriptEntry is one line of the transcript file
+type TranscriptEntry struct {
+	ChatID    int64     `json:"chat_id"`
+	Username  string    `json:"username"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+	IsBot     bool      `json:"is_bot"`
+}
+
+// TranscriptWriter appends messages to a JSON lines file through a buffer,
+// rotating the file when it grows past maxBytes
+type TranscriptWriter struct {
+	path     string
+	maxBytes int64
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	mutex    sync.Mutex
+}
+
+// NewTranscriptWriter opens path for appending, creating it if needed
+func NewTranscriptWriter(path string, maxBytes int64) (*TranscriptWriter, error) {
+	t := &TranscriptWriter{path: path, maxBytes: maxBytes}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TranscriptWriter) open() error {
+	file, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening transcript file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error reading transcript file: %v", err)
+	}
+	t.file = file
+	t.writer = bufio.NewWriter(file)
+	t.size = info.Size()
+	return nil
+}
+
+// rotate moves the full file aside, replacing any earlier one, and starts
+// a new one. If the file can't be moved it's reopened to keep appending,
+// and rotation is tried again on the next entry. If it can't be reopened
+// the file is left nil for record to retry. Called with the mutex held.
+func (t *TranscriptWriter) rotate() error {
+	if err := t.writer.Flush(); err != nil {
+		return fmt.Errorf("error writing transcript file: %v", err)
+	}
+	t.file.Close()
+	t.file, t.writer = nil, nil
+
+	renameErr := os.Rename(t.path, t.path+".1")
+	if err := t.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("error rotating transcript file: %v", renameErr)
+	}
+	return nil
+}
+
+// record buffers an entry; a nil writer (transcripts off) does nothing
+func (t *TranscriptWriter) record(entry TranscriptEntry) {
+	if t == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logError("Error marshaling transcript entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file != nil && t.size > 0 && t.size+int64(len(line)) > t.maxBytes {
+		if err := t.rotate(); err != nil {
+			logError("Failed to rotate transcript: %v", err)
+		}
+	}
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			logError("Failed to write transcript: %v", err)
+			return
+		}
+	}
+	n, err := t.writer.Write(line)
+	t.size += int64(n)
+	if err != nil {
+		logError("Failed to write transcript: %v", err)
+	}
+}
+
+// flush writes out buffered entries
+func (t *TranscriptWriter) flush() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writer == nil {
+		return nil
+	}
+	return t.writer.Flush()
+}
+
+// autoflush flushes the transcript every transcriptFlushInterval until stop
+// is closed
+func (t *TranscriptWriter) autoflush(stop <-chan struct{}) {
+	ticker := time.NewTicker(transcriptFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.flush(); err != nil {
+				logError("Failed to write transcript: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// transcriptLog is set from transcript_file at startup; nil when off
+var transcriptLog *TranscriptWriter
+
+// startupNotificationWorkers bounds how many startup notifications are sent
+// at once; sendLimits keeps them under Telegram's rate limits
+const startupNotificationWorkers = 5
+
+func sendStartupNotifications(bot *telebot.Bot, status *BotStatus, config Config) {
+	// Skip notifications if message is empty
+	if config.StartupMessage == "" {
+		logInfo("Startup message is empty, skipping notifications")
+		return
+	}
+
+	status.mutex.Lock()
+	var chatIDs []int64
+	for _, chatID := range status.ChatIDs {
+		if settings, exists := status.ChatSettings[chatID]; exists && settings.Quiet {
+			continue
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	status.mutex.Unlock()
+
+	if len(chatIDs) == 0 {
+		logInfo("No chats to send startup notifications to")
+		return
+	}
+
+	if maxDelay := config.StartupNotificationDelaySeconds; maxDelay > 0 {
+		delay := time.Duration(rand.Int63n(int64(maxDelay) * int64(time.Second)))
+		logInfo("Waiting %s before sending startup notifications", delay.Round(time.Second))
+		time.Sleep(delay)
+	}
+
+	logInfo("Sending startup notifications to %d chats", len(chatIDs))
+
+	jobs := make(chan int64)
+	var failed []int64
+	var failedMutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < startupNotificationWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chatID := range jobs {
+				chat := &telebot.Chat{ID: chatID}
+				_, err := sendThrottled(bot, chat, config.StartupMessage)
+				if err != nil {
+					logError("Failed to send startup message to chat %d: %v", chatID, err)
+					failedMutex.Lock()
+					failed = append(failed, chatID)
+					failedMutex.Unlock()
+				} else {
+					logInfo("Sent startup notification to chat %d", chatID)
+				}
+			}
+		}()
+	}
+
+	for _, chatID := range chatIDs {
+		jobs <- chatID
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Stop tracking chats we can no longer reach
+	for _, chatID := range failed {
+		status.removeChatID(chatID)
+	}
+}
+
+func handleChatMember(bot *telebot.Bot, status *BotStatus, contextManager *ContextManager, update *telebot.ChatMemberUpdate) {
+	logDebug("Chat member update received: user %d in chat %d", update.NewChatMember.User.ID, update.Chat.ID)
+
+	if update.NewChatMember.User.ID == bot.Me.ID {
+		logInfo("Bot membership changed in chat %d, role: %s", update.Chat.ID, update.NewChatMember.Role)
+
+		switch update.NewChatMember.Role {
+		case telebot.Member, telebot.Administrator, telebot.Creator:
+			logInfo("Bot added to chat %d", update.Chat.ID)
+			status.addChatID(update.Chat.ID)
+		case telebot.Left, telebot.Kicked:
+			logInfo("Bot removed from chat %d", update.Chat.ID)
+			// Clear the context for this chat
+			contextManager.clearContext(update.Chat.ID)
+			status.removeChatID(update.Chat.ID)
+		}
+	}
+}
+
+// commandArgs reports whether text is the given command, returning whatever
+// follows the command with its original case preserved
+func commandArgs(text string, command string) (string, bool) {
+	if len(text) < len(command) || !strings.EqualFold(text[:len(command)], command) {
+		return "", false
+	}
+	rest := text[len(command):]
+	if rest != "" && rest[0] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// commandHelp lists the commands shown in the help text, without the
+// trigger word
+var commandHelp = []struct {
+	usage       string
+	description string
+}{
+	{"STOP", "Remove chat from tracking"},
+	{"START", "Add chat to tracking"},
+	{"MUTE", "Stop replying but keep tracking and history"},
+	{"UNMUTE", "Start replying again"},
+	{"QUIET", "Don't send startup notifications here"},
+	{"ANNOUNCE", "Send startup notifications here again"},
+	{"RESET", "Clear conversation history"},
+	{"STATUS", "Show bot status for this chat"},
+	{"WHOAMI", "Show how the bot labels you to the model"},
+	{"PING", "Check the bot is alive, without calling the model"},
+	{"PROMPT <text>", "Set a custom system prompt for this chat"},
+	{"PROMPT RESET", "Restore the default system prompt"},
+	{"MODEL", "Show the model used in this chat"},
+	{"MODEL <name>", "Use a different model in this chat"},
+	{"MODEL RESET", "Go back to the configured model"},
+	{"PERSONA", "List personas and show the one in use"},
+	{"PERSONA <name>", "Switch this chat to another persona"},
+	{"PERSONA RESET", "Go back to the default persona"},
+	{"TEMP", "Show the temperature used in this chat"},
+	{"TEMP <0.0-2.0>", "Use a different temperature in this chat"},
+	{"TEMP RESET", "Go back to the configured temperature"},
+	{"LANG", "Show the language Frank replies in here"},
+	{"LANG <language>", "Have Frank reply in a language, e.g. de or Spanish"},
+	{"LANG RESET", "Let Frank pick the language again"},
+	{"SUMMARIZE", "Condense older history into a summary"},
+	{"HISTORY [n]", "Show the last n messages the model sees (admins only)"},
+	{"EXPORT", "Send the conversation history as a text file"},
+	{"RELOAD", "Re-read the system prompt file (admins only)"},
+}
+
+// helpText lists the available commands prefixed with the trigger word
+func helpText(trigger string) string {
+	var help strings.Builder
+	help.WriteString("❓ Unknown command. Available commands:")
+	for _, command := range commandHelp {
+		fmt.Fprintf(&help, "\n• %s %s - %s", trigger, command.usage, command.description)
+	}
+	return help.String()
+}
+
+// isCommand reports whether text is addressed to the bot as a command, i.e.
+// starts with the trigger word followed by something else
+func isCommand(text string, trigger string) bool {
+	rest, ok := commandArgs(strings.TrimSpace(text), trigger)
+	return ok && rest != ""
+}
+
+func handleFrankCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, provider LLMProvider, status *BotStatus, m *telebot.Message) {
+	chatID := m.Chat.ID
+	trigger := config.TriggerWord
+	text, ok := commandArgs(strings.TrimSpace(m.Text), trigger)
+	if !ok {
+		trigger = config.triggerWord(status.chatSettings(chatID).Persona)
+		text, _ = commandArgs(strings.TrimSpace(m.Text), trigger)
+	}
+	command := strings.ToUpper(text)
+
+	logInfo("Received %s command: '%s' from chat %d", trigger, command, chatID)
+
+	if prompt, ok := commandArgs(text, "PROMPT"); ok {
+		handlePromptCommand(bot, contextManager, config, status, m, prompt)
+		return
+	}
+
+	if model, ok := commandArgs(text, "MODEL"); ok {
+		handleModelCommand(bot, contextManager, config, status, m, model)
+		return
+	}
+
+	if persona, ok := commandArgs(text, "PERSONA"); ok {
+		handlePersonaCommand(bot, contextManager, config, status, m, persona)
+		return
+	}
+
+	if temperature, ok := commandArgs(text, "TEMP"); ok {
+		handleTempCommand(bot, contextManager, config, status, m, temperature)
+		return
+	}
+
+	if language, ok := commandArgs(text, "LANG"); ok {
+		handleLangCommand(bot, contextManager, status, m, language)
+		return
+	}
+
+	if command == "SUMMARIZE" {
+		handleSummarizeCommand(bot, contextManager, config, provider, m)
+		return
+	}
+
+	if count, ok := commandArgs(text, "HISTORY"); ok {
+		handleHistoryCommand(bot, contextManager, config, m, count)
+		return
+	}
+
+	if command == "EXPORT" {
+		handleExportCommand(bot, contextManager, config, m)
+		return
+	}
+
+	if command == "RELOAD" {
+		handleReloadCommand(bot, contextManager, config, status, m)
+		return
+	}
+
+	switch command {
+	case "STOP":
+		status.removeChatID(chatID)
+		logInfo("Chat %d removed from tracking via %s STOP command", chatID, trigger)
+		bot.Send(m.Chat, "✅ Chat removed from tracking - bot will no longer send startup notifications here")
+
+	case "START":
+		status.addChatID(chatID)
+		logInfo("Chat %d added to tracking via %s START command", chatID, trigger)
+		bot.Send(m.Chat, "✅ Chat added to tracking - bot will send startup notifications here")
+
+	case "MUTE", "UNMUTE":
+		muted := command == "MUTE"
+		status.updateChatSettings(chatID, func(settings *ChatSettings) {
+			settings.Muted = muted
+		})
+		if muted {
+			logInfo("Chat %d muted via %s MUTE command", chatID, trigger)
+			bot.Send(m.Chat, "🔇 Muted - Frank will keep listening but won't reply")
+		} else {
+			logInfo("Chat %d unmuted via %s UNMUTE command", chatID, trigger)
+			bot.Send(m.Chat, "🔊 Unmuted - Frank will reply again")
+		}
+
+	case "QUIET", "ANNOUNCE":
+		quiet := command == "QUIET"
+		status.updateChatSettings(chatID, func(settings *ChatSettings) {
+			settings.Quiet = quiet
+		})
+		if quiet {
+			logInfo("Chat %d startup notifications off via %s QUIET command", chatID, trigger)
+			bot.Send(m.Chat, "🤫 Startup notifications off for this chat")
+		} else {
+			logInfo("Chat %d startup notifications on via %s ANNOUNCE command", chatID, trigger)
+			bot.Send(m.Chat, "📣 Startup notifications on for this chat")
+		}
+
+	case "RESET":
+		contextManager.resetContext(m.Chat, threadOf(m))
+		bot.Send(m.Chat, "✅ Conversation history cleared")
+
+	case "STATUS":
+		bot.Send(m.Chat, statusReport(contextManager, config, status, chatID, threadOf(m)))
+
+	case "WHOAMI":
+		bot.Send(m.Chat, whoamiReport(bot, config, m))
+
+	case "PING":
+		bot.Send(m.Chat, pingReport(bot))
+
+	default:
+		logWarn("Unknown %s command: '%s'", trigger, command)
+		bot.Send(m.Chat, helpText(trigger))
+	}
+}
+
+func handlePersonaCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, status *BotStatus, m *telebot.Message, name string) {
+	chatID := m.Chat.ID
+	settings := status.chatSettings(chatID)
+
+	if name == "" {
+		current := "the default"
+		if p, ok := config.persona(settings.Persona); ok {
+			current = p.Name
+		}
+		if len(config.Personas) == 0 {
+			bot.Send(m.Chat, "🎭 No personas are configured")
+			return
+		}
+		names := make([]string, len(config.Personas))
+		for i, p := range config.Personas {
+			names[i] = p.Name
+		}
+		bot.Send(m.Chat, fmt.Sprintf("🎭 Using %s persona. Available: %s", current, strings.Join(names, ", ")))
+		return
+	}
+
+	persona := ""
+	if !strings.EqualFold(name, "RESET") {
+		p, ok := config.persona(name)
+		if !ok {
+			bot.Send(m.Chat, fmt.Sprintf("❌ Unknown persona %q", name))
+			return
+		}
+		persona = p.Name
+	}
+
+	status.updateChatSettings(chatID, func(settings *ChatSettings) {
+		settings.Persona = persona
+	})
+
+	// A custom prompt set with PROMPT takes precedence over the persona's
+	for _, context := range contextManager.chatContexts(m.Chat) {
+		context.Mutex.Lock()
+		context.Persona = persona
+		if settings.SystemPrompt == "" {
+			context.SystemMessage = defaultPrompt(config, persona, m.Chat)
+		}
+		context.Mutex.Unlock()
+	}
+
+	if persona == "" {
+		logInfo("Chat %d persona reset to default", chatID)
+		bot.Send(m.Chat, "✅ Persona reset to the default")
+	} else {
+		logInfo("Chat %d persona set to %s", chatID, persona)
+		bot.Send(m.Chat, fmt.Sprintf("✅ Now speaking as %s (trigger word %s)", persona, config.triggerWord(persona)))
+	}
+}
+
+// handleTempCommand shows or sets the sampling temperature for the chat
+func handleTempCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, status *BotStatus, m *telebot.Message, value string) {
+	chatID := m.Chat.ID
+
+	if value == "" {
+		switch current := status.chatSettings(chatID).Temperature; {
+		case current != nil:
+			bot.Send(m.Chat, fmt.Sprintf("🌡️ Using temperature %g in this chat", *current))
+		case config.OpenAITemperature != nil:
+			bot.Send(m.Chat, fmt.Sprintf("🌡️ Using the default temperature: %g", *config.OpenAITemperature))
+		default:
+			bot.Send(m.Chat, "🌡️ Using the API's default temperature")
+		}
+		return
+	}
+
+	var temperature *float64
+	if !strings.EqualFold(value, "RESET") {
+		parsed, err := strconv.ParseFloat(value, 64)
+		// Written so that NaN, which compares false with everything, fails
+		if err != nil || !(parsed >= 0 && parsed <= 2) {
+			bot.Send(m.Chat, "❌ Temperature must be a number from 0.0 to 2.0")
+			return
+		}
+		if config.Provider == "anthropic" && parsed > 1 {
+			bot.Send(m.Chat, "❌ Anthropic models only accept a temperature from 0.0 to 1.0")
+			return
+		}
+		temperature = &parsed
+	}
+
+	status.updateChatSettings(chatID, func(settings *ChatSettings) {
+		settings.Temperature = temperature
+	})
+
+	for _, context := range contextManager.chatContexts(m.Chat) {
+		context.Mutex.Lock()
+		context.Temperature = temperature
+		context.Mutex.Unlock()
+	}
+
+	if temperature == nil {
+		logInfo("Chat %d temperature reset to default", chatID)
+		bot.Send(m.Chat, "✅ Temperature reset to the default")
+	} else {
+		logInfo("Chat %d temperature set to %g", chatID, *temperature)
+		bot.Send(m.Chat, fmt.Sprintf("✅ Temperature set to %g for this chat", *temperature))
+	}
+}
+
+// handleLangCommand shows or sets the language Frank replies in for the chat
+func handleLangCommand(bot *telebot.Bot, contextManager *ContextManager, status *BotStatus, m *telebot.Message, language string) {
+	chatID := m.Chat.ID
+
+	if language == "" {
+		if current := status.chatSettings(chatID).Language; current != "" {
+			bot.Send(m.Chat, fmt.Sprintf("🌐 Replying in %s in this chat", current))
+		} else {
+			bot.Send(m.Chat, "🌐 No language set, Frank follows the conversation")
+		}
+		return
+	}
+
+	if strings.ContainsAny(language, "\n") {
+		bot.Send(m.Chat, "❌ The language must be on one line")
+		return
+	}
+
+	if strings.EqualFold(language, "RESET") {
+		language = ""
+	}
+
+	status.updateChatSettings(chatID, func(settings *ChatSettings) {
+		settings.Language = language
+	})
+
+	for _, context := range contextManager.chatContexts(m.Chat) {
+		context.Mutex.Lock()
+		context.Language = language
+		context.Mutex.Unlock()
+	}
+
+	if language == "" {
+		logInfo("Chat %d language reset", chatID)
+		bot.Send(m.Chat, "✅ Language reset, Frank follows the conversation")
+	} else {
+		logInfo("Chat %d language set to %s", chatID, language)
+		bot.Send(m.Chat, fmt.Sprintf("✅ Frank will reply in %s in this chat", language))
+	}
+}
+
+func handleModelCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, status *BotStatus, m *telebot.Message, model string) {
+	chatID := m.Chat.ID
+
+	if model == "" {
+		context := contextManager.getContext(m.Chat, threadOf(m))
+		context.Mutex.Lock()
+		current := context.Model
+		context.Mutex.Unlock()
+
+		if current == "" {
+			bot.Send(m.Chat, fmt.Sprintf("🤖 Using the default model: %s", config.OpenAIModel))
+		} else {
+			bot.Send(m.Chat, fmt.Sprintf("🤖 Using model %s in this chat (default is %s)", current, config.OpenAIModel))
+		}
+		return
+	}
+
+	if strings.ContainsAny(model, " \t\n") {
+		bot.Send(m.Chat, "❌ Model names can't contain spaces")
+		return
+	}
+
+	if strings.EqualFold(model, "RESET") {
+		model = ""
+	}
+
+	status.updateChatSettings(chatID, func(settings *ChatSettings) {
+		settings.Model = model
+	})
+
+	for _, context := range contextManager.chatContexts(m.Chat) {
+		context.Mutex.Lock()
+		context.Model = model
+		context.Mutex.Unlock()
+	}
+
+	if model == "" {
+		logInfo("Chat %d model reset to default", chatID)
+		bot.Send(m.Chat, fmt.Sprintf("✅ Model reset to the default: %s", config.OpenAIModel))
+	} else {
+		logInfo("Chat %d model set to %s", chatID, model)
+		bot.Send(m.Chat, fmt.Sprintf("✅ Model set to %s for this chat", model))
+	}
+}
+
+// recordUsage adds a request's token usage to the chat's totals
+func recordUsage(context *ConversationContext, usage Usage) {
+	context.Mutex.Lock()
+	context.Usage.add(usage)
+	context.DailyUsage.add(usage)
+	context.Mutex.Unlock()
+}
+
+// usageLogInterval is how often each chat's token usage is logged
+const usageLogInterval = 24 * time.Hour
+
+// logDailyUsage logs the tokens each chat used over the last day, and their
+// estimated cost, then starts counting again
+func logDailyUsage(contextManager *ContextManager, config Config) {
+	for range time.Tick(usageLogInterval) {
+		var total Usage
+		for _, key := range contextManager.keys() {
+			context := contextManager.lookupContext(key.ChatID, key.ThreadID)
+			if context == nil {
+				continue
+			}
+
+			context.Mutex.Lock()
+			usage := context.DailyUsage
+			context.DailyUsage = Usage{}
+			context.Mutex.Unlock()
+
+			if usage == (Usage{}) {
+				continue
+			}
+			logInfo("Usage in %s over the last day: %s", key, usage.describe(config))
+			total.add(usage)
+		}
+		logInfo("Usage over the last day: %s", total.describe(config))
+	}
+}
+
+// pingReport times a round trip to the Telegram API, for FRANK PING
+func pingReport(bot *telebot.Bot) string {
+	start := time.Now()
+	_, err := bot.Raw("getMe", nil)
+	elapsed := time.Since(start)
+
+	uptime := time.Since(startTime).Round(time.Second)
+	if err != nil {
+		logWarn("Ping to Telegram failed: %v", err)
+		return fmt.Sprintf("🏓 pong\n• Telegram: error after %s\n• Uptime: %s", elapsed.Round(time.Millisecond), uptime)
+	}
+	return fmt.Sprintf("🏓 pong\n• Telegram round trip: %s\n• Uptime: %s", elapsed.Round(time.Millisecond), uptime)
+}
+
+// whoamiReport describes how the bot sees the sender of m, for FRANK WHOAMI
+func whoamiReport(bot *telebot.Bot, config Config, m *telebot.Message) string {
+	user := m.Sender
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+
+	allowList := "not used"
+	if len(config.AllowedUserIDs) > 0 {
+		allowList = yesNo(slices.Contains(config.AllowedUserIDs, user.ID))
+	}
+
+	var report strings.Builder
+	report.WriteString("👤 Who you are to Frank\n")
+	fmt.Fprintf(&report, "• Label: %s\n", displayName(user))
+	fmt.Fprintf(&report, "• User ID: %d\n", user.ID)
+	fmt.Fprintf(&report, "• On allow list: %s\n", allowList)
+	fmt.Fprintf(&report, "• On block list: %s\n", yesNo(slices.Contains(config.BlockedUserIDs, user.ID)))
+	fmt.Fprintf(&report, "• Bot admin: %s\n", yesNo(isAdmin(bot, config, m.Chat, user)))
+	fmt.Fprintf(&report, "• Heard by Frank: %s", yesNo(isUserAllowed(config, user.ID)))
+	return report.String()
+}
+
+// statusReport describes the bot's state for a chat (or forum topic), for
+// FRANK STATUS
+func statusReport(contextManager *ContextManager, config Config, status *BotStatus, chatID int64, threadID int) string {
+	messages, pending, thumbsUp, thumbsDown := 0, 0, 0, 0
+	var usage Usage
+	model := status.chatSettings(chatID).Model
+	if context := contextManager.lookupContext(chatID, threadID); context != nil {
+		context.Mutex.Lock()
+		messages = len(context.Messages)
+		pending = len(context.PendingMessages)
+		model = context.Model
+		usage = context.Usage
+		context.Mutex.Unlock()
+	}
+	// Reactions don't say which topic they were in, so they're counted
+	// against the chat as a whole
+	if context := contextManager.lookupContext(chatID, 0); context != nil {
+		context.Mutex.Lock()
+		thumbsUp, thumbsDown = context.ThumbsUp, context.ThumbsDown
+		context.Mutex.Unlock()
+	}
+	if model == "" {
+		model = config.OpenAIModel
+	}
+
+	tracked := "no"
+	if status.isTracked(chatID) {
+		tracked = "yes"
+	}
+	if status.chatSettings(chatID).Muted {
+		tracked += " (muted)"
+	}
+
+	var report strings.Builder
+	report.WriteString("📊 Status\n")
+	fmt.Fprintf(&report, "• Tracked: %s\n", tracked)
+	fmt.Fprintf(&report, "• Messages in context: %d\n", messages)
+	fmt.Fprintf(&report, "• Pending in batch: %d\n", pending)
+	fmt.Fprintf(&report, "• Model: %s\n", model)
+	if p, ok := config.persona(status.chatSettings(chatID).Persona); ok {
+		fmt.Fprintf(&report, "• Persona: %s\n", p.Name)
+	}
+	if temperature := status.chatSettings(chatID).Temperature; temperature != nil {
+		fmt.Fprintf(&report, "• Temperature: %g\n", *temperature)
+	}
+	if language := status.chatSettings(chatID).Language; language != "" {
+		fmt.Fprintf(&report, "• Language: %s\n", language)
+	}
+	fmt.Fprintf(&report, "• Feedback: %d 👍 / %d 👎\n", thumbsUp, thumbsDown)
+	fmt.Fprintf(&report, "• Usage: %s\n", usage.describe(config))
+	fmt.Fprintf(&report, "• Uptime: %s", time.Since(startTime).Round(time.Second))
+	return report.String()
+}
+
+// handleSummarizeCommand folds the chat's older history into a summary
+func handleSummarizeCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, provider LLMProvider, m *telebot.Message) {
+	if !isAdmin(bot, config, m.Chat, m.Sender) {
+		bot.Send(m.Chat, "❌ Only admins can summarize the history")
+		return
+	}
+	context := contextManager.getContext(m.Chat, threadOf(m))
+
+	// Shares the guard with autoSummarize so two summaries can't race
+	context.Mutex.Lock()
+	busy := context.Summarizing
+	context.Summarizing = true
+	context.Mutex.Unlock()
+	if busy {
+		bot.Send(m.Chat, "⏳ Already summarizing this conversation")
+		return
+	}
+	defer func() {
+		context.Mutex.Lock()
+		context.Summarizing = false
+		context.Mutex.Unlock()
+	}()
+
+	count, err := summarizeContext(context, config, provider, m.Chat)
+	if errors.Is(err, errNothingToSummarize) {
+		bot.Send(m.Chat, "📭 Not enough history to summarize yet")
+		return
+	}
+	if errors.Is(err, errSummaryStale) {
+		bot.Send(m.Chat, "⚠️ The history changed while summarizing, try again")
+		return
+	}
+	if errors.Is(err, errBreakerOpen) {
+		bot.Send(m.Chat, "⏳ The model is unavailable right now, try again later")
+		return
+	}
+	if err != nil {
+		logError("Failed to summarize chat %d: %v", m.Chat.ID, err)
+		bot.Send(m.Chat, "❌ Failed to summarize the conversation")
+		return
+	}
+
+	bot.Send(m.Chat, fmt.Sprintf("✅ Summarized %d older messages", count))
+}
+
+// historyDefaultCount and historyMaxCount bound how many messages FRANK
+// HISTORY shows; historyLineChars caps each one
+const (
+	historyDefaultCount = 10
+	historyMaxCount     = 50
+	historyLineChars    = 300
+)
+
+// handleExportCommand sends the chat's whole history as a text file, which
+// unlike a message has no length limit
+func handleExportCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, m *telebot.Message) {
+	if config.ExportAdminOnly && !isAdmin(bot, config, m.Chat, m.Sender) {
+		bot.Send(m.Chat, "❌ Only admins can export the history")
+		return
+	}
+
+	context := contextManager.lookupContext(m.Chat.ID, threadOf(m))
+	if context == nil {
+		bot.Send(m.Chat, "📭 No messages in context")
+		return
+	}
+
+	location := config.location()
+	var transcript strings.Builder
+	context.Mutex.Lock()
+	count := len(context.Messages) + len(context.PendingMessages)
+	if context.Summary != "" {
+		fmt.Fprintf(&transcript, "Summary of the earlier conversation:\n%s\n\n", context.Summary)
+	}
+	for _, msg := range slices.Concat(context.Messages, context.PendingMessages) {
+		timestamp := msg.Timestamp.In(location).Format("2006-01-02 15:04")
+		if msg.IsNote {
+			fmt.Fprintf(&transcript, "[%s] [%s]\n", timestamp, msg.Text)
+		} else {
+			fmt.Fprintf(&transcript, "[%s] %s: %s\n", timestamp, msg.Username, msg.Text)
+		}
+	}
+	context.Mutex.Unlock()
+
+	if count == 0 {
+		bot.Send(m.Chat, "📭 No messages in context")
+		return
+	}
+
+	now := time.Now().In(location)
+	document := &telebot.Document{
+		File:     telebot.FromReader(strings.NewReader(transcript.String())),
+		FileName: fmt.Sprintf("chat-%d-%s.txt", m.Chat.ID, now.Format("2006-01-02-1504")),
+		MIME:     "text/plain",
+		Caption:  fmt.Sprintf("📜 %d messages in %s", count, chatTitle(m.Chat)),
+	}
+	if _, err := bot.Send(m.Chat, document); err != nil {
+		logError("Failed to send export to chat %d: %v", m.Chat.ID, err)
+		bot.Send(m.Chat, "❌ Failed to send the export")
+		return
+	}
+	logInfo("Exported %d messages from chat %d for user %d", count, m.Chat.ID, m.Sender.ID)
+}
+
+// handleReloadCommand re-reads system_message_file and applies it to every
+// group chat using the default prompt
+func handleReloadCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, status *BotStatus, m *telebot.Message) {
+	if !isAdmin(bot, config, m.Chat, m.Sender) {
+		bot.Send(m.Chat, "❌ Only admins can reload the system prompt")
+		return
+	}
+	if config.SystemMessageFile == "" {
+		bot.Send(m.Chat, "❌ No system_message_file is configured")
+		return
+	}
+
+	text, err := readSystemMessageFile(config.SystemMessageFile)
+	if err != nil {
+		logError("Failed to reload system prompt: %v", err)
+		bot.Send(m.Chat, fmt.Sprintf("❌ Failed to reload the system prompt: %v", err))
+		return
+	}
+	reloadedSystemMessage.Store(&text)
+
+	// Chats with their own PROMPT keep it
+	for _, key := range contextManager.keys() {
+		if status.chatSettings(key.ChatID).SystemPrompt != "" {
+			continue
+		}
+		context := contextManager.lookupContext(key.ChatID, key.ThreadID)
+		if context == nil {
+			continue
+		}
+		context.Mutex.Lock()
+		context.SystemMessage = defaultPrompt(config, context.Persona, context.Chat)
+		context.Mutex.Unlock()
+	}
+
+	logInfo("System prompt reloaded from %s by user %d", config.SystemMessageFile, m.Sender.ID)
+	bot.Send(m.Chat, fmt.Sprintf("✅ System prompt reloaded from %s (%d characters)", config.SystemMessageFile, utf8.RuneCountInString(text)))
+}
+
+// handleHistoryCommand shows admins the most recent messages in the chat's
+// context, pending ones included, as they are formatted for the model
+func handleHistoryCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, m *telebot.Message, countText string) {
+	if !isAdmin(bot, config, m.Chat, m.Sender) {
+		bot.Send(m.Chat, "❌ Only admins can view the history")
+		return
+	}
+
+	count := historyDefaultCount
+	if countText != "" {
+		n, err := strconv.Atoi(countText)
+		if err != nil || n < 1 {
+			bot.Send(m.Chat, fmt.Sprintf("❓ Usage: %s HISTORY [n]", config.TriggerWord))
+			return
+		}
+		count = min(n, historyMaxCount)
+	}
+
+	var lines []string
+	if context := contextManager.lookupContext(m.Chat.ID, threadOf(m)); context != nil {
+		context.Mutex.Lock()
+		for _, msg := range context.Messages {
+			if msg.IsBot {
+				lines = append(lines, "🤖 "+msg.Text)
+			} else {
+				lines = append(lines, formatUserMessage(msg, config, true))
+			}
+		}
+		for _, msg := range context.PendingMessages {
+			lines = append(lines, "⏳ "+formatUserMessage(msg, config, true))
+		}
+		context.Mutex.Unlock()
+	}
+
+	if len(lines) == 0 {
+		bot.Send(m.Chat, "📭 No messages in context")
+		return
+	}
+
+	lines = lines[max(len(lines)-count, 0):]
+	var history strings.Builder
+	fmt.Fprintf(&history, "📜 Last %d messages in context:", len(lines))
+	for _, line := range lines {
+		history.WriteString("\n\n")
+		history.WriteString(truncateRunes(line, historyLineChars))
+	}
+
+	for _, part := range splitMessage(history.String(), telegramMessageLimit) {
+		if _, err := bot.Send(m.Chat, part); err != nil {
+			logError("Failed to send history to chat %d: %v", m.Chat.ID, err)
+			return
+		}
+	}
+}
+
+func handlePromptCommand(bot *telebot.Bot, contextManager *ContextManager, config Config, status *BotStatus, m *telebot.Message, prompt string) {
+	chatID := m.Chat.ID
+
+	if prompt == "" {
+		bot.Send(m.Chat, fmt.Sprintf("❓ Usage: %[1]s PROMPT <text> or %[1]s PROMPT RESET", config.TriggerWord))
+		return
+	}
+
+	reset := strings.EqualFold(prompt, "RESET")
+	if reset {
+		prompt = ""
+	}
+
+	status.updateChatSettings(chatID, func(settings *ChatSettings) {
+		settings.SystemPrompt = prompt
+	})
+
+	systemMessage := prompt
+	if reset {
+		systemMessage = defaultPrompt(config, status.chatSettings(chatID).Persona, m.Chat)
+	}
+
+	for _, context := range contextManager.chatContexts(m.Chat) {
+		context.Mutex.Lock()
+		context.SystemMessage = systemMessage
+		context.Mutex.Unlock()
+	}
+
+	if reset {
+		logInfo("Chat %d system prompt reset to default", chatID)
+		bot.Send(m.Chat, "✅ System prompt reset to default")
+	} else {
+		logInfo("Chat %d system prompt updated", chatID)
+		bot.Send(m.Chat, "✅ System prompt updated for this chat")
+	}
+}
+
+func handleIncomingMessage(bot *telebot.Bot, contextManager *ContextManager, config Config, client *resty.Client, provider LLMProvider, status *BotStatus, m *telebot.Message) {
+	// Runs in its own goroutine, where a panic would take the bot down
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(r, "handling %s", describeMessage(m))
+		}
+	}()
+
+	hasPhoto := config.VisionEnabled && m.Photo != nil
+	hasVoice := config.TranscriptionURL != "" && m.Voice != nil
+	// Photos, videos and documents carry their text in the caption
+	text := m.Text
+	if strings.TrimSpace(text) == "" {
+		text = m.Caption
+	}
+	if strings.TrimSpace(text) == "" && !hasPhoto && !hasVoice {
+		return
+	}
+
+	if m.Sender.ID == bot.Me.ID {
+		return
+	}
+
+	// Telegram can deliver an update again after a reconnect or restart
+	if !status.markSeen(m.Chat.ID, m.ID) {
+		logDebug("Ignoring already handled message %d in chat %d", m.ID, m.Chat.ID)
+		return
+	}
+
+	allowed := isUserAllowed(config, m.Sender.ID)
+
+	// Check for commands starting with the trigger word, or the trigger
+	// word of the chat's persona
+	trigger := config.triggerWord(status.chatSettings(m.Chat.ID).Persona)
+	if isCommand(m.Text, config.TriggerWord) || isCommand(m.Text, trigger) {
+		if !allowed && !isAdmin(bot, config, m.Chat, m.Sender) {
+			logDebug("Ignoring command from disallowed user %d in chat %d", m.Sender.ID, m.Chat.ID)
+			return
+		}
+		handleFrankCommand(bot, contextManager, config, provider, status, m)
+		return
+	}
+
+	if !allowed {
+		logDebug("Ignoring message from disallowed user %d in chat %d", m.Sender.ID, m.Chat.ID)
+		return
+	}
+
+	// Check if this chat is in our tracking list
+	if !status.isTracked(m.Chat.ID) {
+		logInfo("Ignoring message from untracked chat %d (%s)", m.Chat.ID, m.Chat.Title)
+		return
+	}
+
+	forwarded := isForwarded(m)
+	if forwarded && config.IgnoreForwards {
+		logDebug("Ignoring forwarded message in chat %d", m.Chat.ID)
+		return
+	}
+
+	logInfo("Processing message from tracked chat %d (%s)", m.Chat.ID, m.Chat.Title)
+
+	var images []string
+	if hasPhoto {
+		// Download before taking the context lock so a slow fetch doesn't
+		// block other messages for this chat
+		image, err := downloadPhoto(bot, m.Photo)
+		if err != nil {
+			logError("Failed to download photo in chat %d: %v", m.Chat.ID, err)
+			return
+		}
+		images = append(images, image)
+
+		text = strings.TrimSpace(m.Caption)
+		if text == "" {
+			text = "[sent a photo]"
+		}
+	}
+	if hasVoice {
+		transcript, err := transcribeVoice(bot, client, config, m.Voice)
+		if err != nil {
+			logError("Failed to transcribe voice message in chat %d: %v", m.Chat.ID, err)
+			return
+		}
+		if strings.TrimSpace(transcript) == "" {
+			logWarn("Empty transcription for voice message in chat %d, skipping", m.Chat.ID)
+			return
+		}
+		text = transcript
+	}
+
+	// Mark forwards as quoted so Frank doesn't take them as the sender's
+	// own words
+	if forwarded {
+		text = fmt.Sprintf("[forwarded from %s] %s", forwardSource(m), text)
+	}
+
+	// Get the context for THIS specific chat (and topic)
+	context := contextManager.getContext(m.Chat, threadOf(m))
+
+	context.Mutex.Lock()
+	defer context.Mutex.Unlock()
+
+	username := displayName(m.Sender)
+
+	// A pasted document would otherwise crowd everything else out of the
+	// context for as long as it stays there
+	message := Message{
+		Username:     username,
+		Text:         truncateText(text, config.MaxMessageChars),
+		Timestamp:    m.Time(),
+		IsBot:        false,
+		FromBot:      m.Sender.IsBot,
+		RepliesToBot: m.ReplyTo != nil && m.ReplyTo.Sender != nil && m.ReplyTo.Sender.ID == bot.Me.ID,
+		Images:       images,
+		Source:       m,
+	}
+
+	if len(context.PendingMessages) == 0 {
+		context.FirstPendingAt = time.Now()
+	}
+	context.PendingMessages = append(context.PendingMessages, message)
+	context.LastMessageTime = time.Now()
+	context.Chat = m.Chat
+	transcriptLog.record(TranscriptEntry{
+		ChatID:    m.Chat.ID,
+		Username:  username,
+		Text:      message.Text,
+		Timestamp: message.Timestamp,
+	})
+
+	// Short messages like "ok" wait in the batch for a longer one, without
+	// starting or extending the timer, unless they are addressed to Frank
+	if len(images) == 0 && utf8.RuneCountInString(strings.TrimSpace(text)) < config.MinTriggerLength &&
+		!message.RepliesToBot && !mentionsBot(bot, config.triggerWord(context.Persona), []Message{message}) {
+		logDebug("Message in chat %d is shorter than min_trigger_length, not starting the batch timer", m.Chat.ID)
+		return
+	}
+
+	// If the timer already fired, its processBatch is waiting for the lock
+	// and takes this message too; the new timer then finds nothing pending
+	if context.Timer != nil {
+		context.Timer.Stop()
+	}
+
+	window := config.BatchWindowSeconds
+	if m.Chat.Type == telebot.ChatPrivate && config.PrivateBatchWindowSeconds != nil {
+		window = *config.PrivateBatchWindowSeconds
+	}
+	if endsWithTrigger(text, config.ImmediateTrigger) {
+		logDebug("Immediate trigger in chat %d, sending batch now", m.Chat.ID)
+		window = 0
+	}
+	delay := time.Duration(window) * time.Second
+
+	// In a busy chat each message pushes the batch back again, so Frank
+	// might never get a word in
+	if config.MaxBatchWaitSeconds > 0 {
+		remaining := time.Duration(config.MaxBatchWaitSeconds)*time.Second - time.Since(context.FirstPendingAt)
+		if remaining < delay {
+			logDebug("Batch in chat %d is reaching max_batch_wait_seconds, sending in %v", m.Chat.ID, max(remaining, 0).Round(time.Second))
+			delay = max(remaining, 0)
+		}
+	}
+
+	// Pass contextManager instead of context to processBatch
+	context.Timer = time.AfterFunc(delay, func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(r, "processing batch for chat %d", m.Chat.ID)
+			}
+		}()
+		processBatch(bot, m.Chat, threadOf(m), contextManager, config, provider, status)
+	})
+}
+
+// logPanic logs a recovered panic with its stack trace
+func logPanic(recovered interface{}, format string, args ...interface{}) {
+	logError("Recovered from panic while %s: %v\n%s", fmt.Sprintf(format, args...), recovered, debug.Stack())
+}
+
+// describeMessage identifies a message for logs, coping with missing fields
+func describeMessage(m *telebot.Message) string {
+	if m == nil {
+		return "nil message"
+	}
+	description := fmt.Sprintf("message %d", m.ID)
+	if m.Chat != nil {
+		description += fmt.Sprintf(" in chat %d", m.Chat.ID)
+	}
+	if m.Sender != nil {
+		description += fmt.Sprintf(" from user %d", m.Sender.ID)
+	}
+	return description
+}
+
+// isForwarded reports whether a message was forwarded from elsewhere
+func isForwarded(m *telebot.Message) bool {
+	return m.Origin != nil || m.IsForwarded() || m.OriginalSenderName != ""
+}
+
+// forwardSource names the original author of a forwarded message
+func forwardSource(m *telebot.Message) string {
+	var name string
+	switch {
+	case m.Origin != nil && m.Origin.Sender != nil:
+		name = m.Origin.Sender.FirstName
+		if m.Origin.Sender.LastName != "" {
+			name += " " + m.Origin.Sender.LastName
+		}
+	case m.Origin != nil && m.Origin.SenderUsername != "":
+		name = m.Origin.SenderUsername
+	case m.Origin != nil && m.Origin.SenderChat != nil:
+		name = m.Origin.SenderChat.Title
+	case m.Origin != nil && m.Origin.Chat != nil:
+		name = m.Origin.Chat.Title
+	case m.OriginalSender != nil:
+		name = m.OriginalSender.FirstName
+	case m.OriginalSenderName != "":
+		name = m.OriginalSenderName
+	case m.OriginalChat != nil:
+		name = m.OriginalChat.Title
+	}
+
+	if name == "" {
+		return "someone else"
+	}
+	return sanitizeUsername(name)
+}
+
+// displayName is how a user is named to the model: their username, or
+// their full name if they have none
+func displayName(user *telebot.User) string {
+	name := user.Username
+	if name == "" {
+		name = user.FirstName
+		if user.LastName != "" {
+			name += " " + user.LastName
+		}
+	}
+	return sanitizeUsername(name)
+}
+
+// handleMembership notes in a tracked chat's history that someone joined or
+// left, so Frank can react in his next reply. The note doesn't start a batch.
+func handleMembership(contextManager *ContextManager, config Config, status *BotStatus, chat *telebot.Chat, user *telebot.User, joined bool) {
+	if user == nil || !status.isTracked(chat.ID) {
+		return
+	}
+
+	name := displayName(user)
+	text := name + " left the chat"
+	if joined {
+		text = name + " joined the chat"
+	}
+	logInfo("Chat %d: %s", chat.ID, text)
+
+	context := contextManager.getContext(chat, 0)
+	context.Mutex.Lock()
+	defer context.Mutex.Unlock()
+
+	context.Messages = append(context.Messages, Message{
+		Username:  name,
+		Text:      text,
+		Timestamp: time.Now(),
+		IsNote:    true,
+	})
+	trimContext(context, config.MaxContextChars, config.MaxContextTokens, config.MaxHistoryMessages, config.PinnedHistoryCount)
+}
+
+// endsWithTrigger reports whether text ends with trigger, ignoring case and
+// trailing punctuation; an empty trigger never matches
+func endsWithTrigger(text string, trigger string) bool {
+	trigger = strings.ToLower(strings.TrimSpace(trigger))
+	if trigger == "" {
+		return false
+	}
+	text = strings.ToLower(strings.TrimRight(text, " \t\n.,!?"))
+	return strings.HasSuffix(text, trigger)
+}
+
+// isUserAllowed applies the configured allow and block lists to a sender
+func isUserAllowed(config Config, userID int64) bool {
+	if slices.Contains(config.BlockedUserIDs, userID) {
+		return false
+	}
+	return len(config.AllowedUserIDs) == 0 || slices.Contains(config.AllowedUserIDs, userID)
+}
+
+// isAdmin reports whether user is a configured bot admin or an
+// administrator of the chat
+func isAdmin(bot *telebot.Bot, config Config, chat *telebot.Chat, user *telebot.User) bool {
+	if slices.Contains(config.AdminUserIDs, user.ID) {
+		return true
+	}
+
+	member, err := bot.ChatMemberOf(chat, user)
+	if err != nil {
+		logDebug("Failed to look up chat member %d in chat %d: %v", user.ID, chat.ID, err)
+		return false
+	}
+	return member.Role == telebot.Administrator || member.Role == telebot.Creator
+}
+
+// downloadPhoto fetches a photo from Telegram and returns it as a base64
+// JPEG data URL suitable for a multimodal model
+func downloadPhoto(bot *telebot.Bot, photo *telebot.Photo) (string, error) {
+	reader, err := bot.File(&photo.File)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch file: %v", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// transcribeVoice downloads a voice note and sends it to the configured
+// Whisper-compatible endpoint, returning the transcribed text
+func transcribeVoice(bot *telebot.Bot, client *resty.Client, config Config, voice *telebot.Voice) (string, error) {
+	reader, err := bot.File(&voice.File)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch file: %v", err)
+	}
+	defer reader.Close()
+
+	var response struct {
+		Text string `json:"text"`
+	}
+
+	resp, err := client.R().
+		SetHeader("Authorization", "Bearer "+config.TranscriptionAPIKey).
+		SetFileReader("file", "voice.ogg", reader).
+		SetFormData(map[string]string{"model": config.TranscriptionModel}).
+		SetResult(&response).
+		Post(config.TranscriptionURL)
+
+	if err != nil {
+		return "", fmt.Errorf("HTTP request failed: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return "", &APIError{StatusCode: resp.StatusCode(), Body: resp.String()}
+	}
+
+	return response.Text, nil
+}
+
+// sortMessages orders messages by send time. Telegram timestamps only have
+// one-second resolution, so ties fall back to the message ID, which grows
+// with each message in a chat. Messages without a source keep their order.
+func sortMessages(messages []Message) {
+	slices.SortStableFunc(messages, func(a, b Message) int {
+		if c := a.Timestamp.Compare(b.Timestamp); c != 0 || a.Source == nil || b.Source == nil {
+			return c
+		}
+		return cmp.Compare(a.Source.ID, b.Source.ID)
+	})
+}
+
+// dedupeMessages drops messages that repeat the same user's previous message
+// in the batch word for word, as happens with double-taps and redelivered
+// updates. The same text from different users is kept.
+func dedupeMessages(messages []Message) []Message {
+	deduped := make([]Message, 0, len(messages))
+	lastText := make(map[string]string)
+
+	for _, msg := range messages {
+		if previous, seen := lastText[msg.Username]; seen && previous == msg.Text {
+			logDebug("Dropping duplicate message from %s in batch", msg.Username)
+			continue
+		}
+		lastText[msg.Username] = msg.Text
+		deduped = append(deduped, msg)
+	}
+
+	return deduped
+}
+
+// mergeConsecutiveMessages joins runs of messages from the same sender in
+// the same thread into one message, keeping the time and source of the last
+func mergeConsecutiveMessages(messages []Message) []Message {
+	merged := make([]Message, 0, len(messages))
+
+	for _, msg := range messages {
+		if n := len(merged); n > 0 && sameSpeaker(merged[n-1], msg) {
+			last := &merged[n-1]
+			last.Text += "\n" + msg.Text
+			last.Timestamp = msg.Timestamp
+			last.Images = append(last.Images, msg.Images...)
+			if msg.Source != nil {
+				last.Source = msg.Source
+			}
+			continue
+		}
+		// Copy the images so appending to a merged message can't write
+		// into another message's slice
+		msg.Images = slices.Clone(msg.Images)
+		merged = append(merged, msg)
+	}
+
+	return merged
+}
+
+// mergeMaxGap is the longest pause between two messages from one sender
+// that still counts as the same thought
+const mergeMaxGap = time.Minute
+
+// sameSpeaker reports whether b continues a's thought: user messages from
+// the same sender in the same thread, close together in time. Replies and
+// forwards stand on their own.
+func sameSpeaker(a, b Message) bool {
+	if a.IsBot || b.IsBot || a.Username != b.Username {
+		return false
+	}
+	if b.Timestamp.Sub(a.Timestamp) > mergeMaxGap {
+		return false
+	}
+	for _, m := range []*telebot.Message{a.Source, b.Source} {
+		if m != nil && (m.ReplyTo != nil || isForwarded(m)) {
+			return false
+		}
+	}
+	if a.Source != nil && b.Source != nil && a.Source.ThreadID != b.Source.ThreadID {
+		return false
+	}
+	return true
+}
+
+// mentionsBot reports whether any message in the batch mentions the trigger
+// word or the bot by name
+func mentionsBot(bot *telebot.Bot, trigger string, pending []Message) bool {
+	names := []string{strings.ToLower(trigger), strings.ToLower(bot.Me.FirstName)}
+	if bot.Me.Username != "" {
+		names = append(names, "@"+strings.ToLower(bot.Me.Username))
+	}
+	for _, msg := range pending {
+		text := strings.ToLower(msg.Text)
+		for _, name := range names {
+			if name != "" && strings.Contains(text, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shouldRespond decides from a batch of pending messages whether the bot
+// should reply, according to the configured respond mode
+func shouldRespond(bot *telebot.Bot, config Config, chat *telebot.Chat, trigger string, pending []Message) bool {
+	// Everything in a private chat is addressed to Frank
+	if chat.Type == telebot.ChatPrivate {
+		return true
+	}
+
+	switch config.RespondMode {
+	case "mention":
+		return mentionsBot(bot, trigger, pending)
+
+	case "reply":
+		for _, msg := range pending {
+			if msg.RepliesToBot {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// acquireRequestSlot blocks until fewer than max_concurrent_requests LLM
+// calls are in flight. The returned release function is safe to call more
+// than once.
+func acquireRequestSlot(requestID string, chat *telebot.Chat) func() {
+	select {
+	case requestSlots <- struct{}{}:
+	default:
+		logInfo("[%s] Chat %d waiting for a free request slot (%d in flight)", requestID, chat.ID, cap(requestSlots))
+		start := time.Now()
+		requestSlots <- struct{}{}
+		logDebug("[%s] Chat %d got a request slot after %v", requestID, chat.ID, time.Since(start))
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-requestSlots })
+	}
+}
+
+// hasHumanMessage reports whether any message in the batch was sent by a
+// person rather than a bot account
+func hasHumanMessage(messages []Message) bool {
+	for _, msg := range messages {
+		if !msg.FromBot {
+			return true
+		}
+	}
+	return false
+}
+
+// CircuitBreaker stops LLM calls for a cooldown once too many have failed
+// in a row, then lets a single trial call through to see whether the API
+// has recovered
+type CircuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int       // consecutive failed calls
+	openedAt  time.Time // when the breaker last opened
+	trial     bool      // a call is testing the API after the cooldown
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether an LLM call may go ahead. Every allowed call must
+// be followed by record.
+func (cb *CircuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if cb.failures < cb.threshold {
+		return true
+	}
+	if cb.trial || time.Since(cb.openedAt) < cb.cooldown {
+		return false
+	}
+	cb.trial = true
+	logInfo("Circuit breaker cooldown over, trying the LLM API again")
+	return true
+}
+
+// record notes the outcome of an allowed call, opening the breaker after
+// too many failures and closing it again on success
+func (cb *CircuitBreaker) record(err error) {
+	if cb == nil {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.trial = false
+	if err == nil {
+		if cb.failures >= cb.threshold {
+			logInfo("LLM API is answering again, closing the circuit breaker")
+		}
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.openedAt = time.Now()
+		logWarn("%d LLM calls failed in a row, skipping calls for %v", cb.failures, cb.cooldown)
+	}
+}
+
+// allowRequest checks the chat's rate limiter and the circuit breaker
+// before an LLM call, sending the configured notice at most once per
+// cooldown when a call is skipped
+func allowRequest(bot *telebot.Bot, chat *telebot.Chat, context *ConversationContext, config Config) bool {
+	if context.RateLimiter != nil && !context.RateLimiter.Allow() {
+		logWarn("Rate limit exceeded for chat %d, skipping LLM call", chat.ID)
+		sendLimitedNotice(bot, chat, context, config, config.RateLimitNotice, &context.LastRateLimitNoticeAt, rateLimitNoticeCooldown)
+		return false
+	}
+
+	if !llmBreaker.allow() {
+		logWarn("Circuit breaker open, skipping LLM call for chat %d", chat.ID)
+		cooldown := time.Duration(config.CircuitBreakerCooldownSeconds) * time.Second
+		sendLimitedNotice(bot, chat, context, config, config.CircuitBreakerNotice, &context.LastBreakerNoticeAt, cooldown)
+		return false
+	}
+
+	return true
+}
+
+// sendLimitedNotice sends notice to the chat unless it is empty or one was
+// sent (as recorded in lastSent, guarded by the context mutex) within
+// cooldown
+func sendLimitedNotice(bot *telebot.Bot, chat *telebot.Chat, context *ConversationContext, config Config, notice string, lastSent *time.Time, cooldown time.Duration) {
+	if notice == "" || config.DryRun {
+		return
+	}
+
+	context.Mutex.Lock()
+	due := time.Since(*lastSent) >= cooldown
+	if due {
+		*lastSent = time.Now()
+	}
+	context.Mutex.Unlock()
+
+	if due {
+		if _, err := sendThrottled(bot, chat, notice); err != nil {
+			logError("Failed to send notice to chat %d: %v", chat.ID, err)
+		}
+	}
+}
+
+func processBatch(bot *telebot.Bot, chat *telebot.Chat, threadID int, contextManager *ContextManager, config Config, provider LLMProvider, status *BotStatus) {
+	// Get the context for THIS specific chat (and topic)
+	context := contextManager.getContext(chat, threadID)
+
+	var (
+		pending        []Message
+		openAIMessages []OpenAIMessage
+		options        RequestOptions
+		sendOptions    telebot.SendOptions
+		sinceReply     time.Duration
+		trigger, name  string
+	)
+	// Unlocks with a defer so a recovered panic can't leave the chat's
+	// context locked for good
+	taken := func() bool {
+		context.Mutex.Lock()
+		defer context.Mutex.Unlock()
+
+		if len(context.PendingMessages) == 0 {
+			return false
+		}
+
+		// Handlers run concurrently, so messages can be enqueued out of
+		// order; sort by send time so the model sees the conversation as
+		// it happened
+		sortMessages(context.PendingMessages)
+		pending = dedupeMessages(context.PendingMessages)
+		if config.MergeConsecutiveMessages {
+			pending = mergeConsecutiveMessages(pending)
+		}
+		context.Messages = append(context.Messages, pending...)
+		context.PendingMessages = []Message{}
+		context.Timer = nil
+
+		// Trim with the batch included so a burst of long messages can't
+		// push the request past the context budget
+		trimContext(context, config.MaxContextChars, config.MaxContextTokens, config.MaxHistoryMessages, config.PinnedHistoryCount)
+
+		openAIMessages = formatMessagesForContext(context, config, chat)
+		options = RequestOptions{Model: context.Model, Temperature: context.Temperature, RequestID: newRequestID()}
+		sendOptions = replyOptions(config, pending)
+		sinceReply = time.Since(context.LastReplyAt)
+		trigger = config.triggerWord(context.Persona)
+		name = config.assistantName(context.Persona)
+		return true
+	}()
+	if !taken {
+		return
+	}
+	// Runs after the reply, by which point the context lock is released
+	defer autoSummarize(context, config, provider, chat)
+
+	// The batch stays in history either way so later replies have context
+	if status.chatSettings(chat.ID).Muted {
+		logInfo("Not responding in chat %d: chat is muted", chat.ID)
+		return
+	}
+
+	if !shouldRespond(bot, config, chat, trigger, pending) {
+		logInfo("Not responding in chat %d: batch doesn't match respond_mode %q", chat.ID, config.RespondMode)
+		return
+	}
+
+	// Frank skips some group batches at random, but never ignores his name
+	if p := config.ResponseProbability; p != nil && chat.Type != telebot.ChatPrivate && !mentionsBot(bot, trigger, pending) && rand.Float64() >= *p {
+		logInfo("Not responding in chat %d: skipped by response_probability %g", chat.ID, *p)
+		return
+	}
+
+	// Only other bots have spoken since Frank's last reply; wait out the
+	// cooldown so bots can't keep answering each other
+	cooldown := time.Duration(config.MinReplyIntervalSeconds) * time.Second
+	if sinceReply < cooldown && !hasHumanMessage(pending) {
+		logInfo("Not responding in chat %d: replied %v ago and no human has spoken since", chat.ID, sinceReply.Round(time.Second))
+		return
+	}
+
+	if !allowRequest(bot, chat, context, config) {
+		return
+	}
+
+	logInfo("[%s] Requesting reply for chat %d with %d messages (%s)", options.RequestID, chat.ID, len(openAIMessages), options.model(config))
+
+	stopTyping := func() {}
+	if !config.DryRun {
+		stopTyping = keepTyping(bot, chat)
+	}
+	defer stopTyping()
+
+	// renderReply strips the interest tag for display, hiding the reply
+	// entirely when Frank isn't interested enough to speak
+	renderReply := func(text string) string {
+		level, reply := parseInterest(stripSpeakerPrefix(text, name))
+		if level != "" && !interestAtLeast(level, config.MinInterest) {
+			return ""
+		}
+		return reply
+	}
+
+	if streamer, ok := provider.(StreamingProvider); ok && config.StreamResponses && !config.DryRun {
+		releaseSlot := acquireRequestSlot(options.RequestID, chat)
+		response, usage, err := streamResponse(bot, chat, config, streamer, openAIMessages, options, sendOptions, renderReply)
+		releaseSlot()
+		recordUsage(context, usage)
+		if retryMessages, ok := shrinkForRetry(context, config, provider, chat, options, err, len(pending)); ok {
+			openAIMessages = retryMessages
+			releaseRetrySlot := acquireRequestSlot(options.RequestID, chat)
+			response, usage, err = streamResponse(bot, chat, config, streamer, openAIMessages, options, sendOptions, renderReply)
+			releaseRetrySlot()
+			recordUsage(context, usage)
+		}
+		llmBreaker.record(err)
+		stopTyping()
+		if err != nil {
+			logError("[%s] OpenAI API error for chat %d: %v", options.RequestID, chat.ID, err)
+			// Keep the part of the reply that reached the chat, so the
+			// history matches what people saw
+			if response != "" {
+				context.Mutex.Lock()
+				addToContext(context, config, config.assistantName(context.Persona), response, true)
+				context.LastReplyAt = time.Now()
+				context.Mutex.Unlock()
+			}
+			if untrackIfUnreachable(contextManager, status, chat, err) {
+				return
+			}
+			notifyError(bot, chat, context, config, err)
+			return
+		}
+		logDebug("[%s] Response for chat %d: %q", options.RequestID, chat.ID, response)
+		response = stripSpeakerPrefix(response, name)
+
+		if !recordInterest(context, config, chat, response) {
+			return
+		}
+
+		context.Mutex.Lock()
+		addToContext(context, config, config.assistantName(context.Persona), response, true)
+		context.LastReplyAt = time.Now()
+		context.Mutex.Unlock()
+		return
+	}
+
+	completion, err := completeWithRetry(context, config, provider, chat, openAIMessages, options, name, len(pending))
+	llmBreaker.record(err)
+	if err != nil {
+		stopTyping()
+		logError("[%s] LLM API error for chat %d: %v", options.RequestID, chat.ID, err)
+		if !config.DryRun {
+			notifyError(bot, chat, context, config, err)
+		}
+		return
+	}
+	logDebug("[%s] Response for chat %d from %s (finish reason %q): %q", options.RequestID, chat.ID, completion.Model, completion.FinishReason, completion.Content)
+	if completion.FinishReason == "length" {
+		logWarn("[%s] Reply for chat %d was cut off at the token limit", options.RequestID, chat.ID)
+	}
+	response := stripSpeakerPrefix(completion.Content, name)
+
+	if !recordInterest(context, config, chat, response) {
+		return
+	}
+
+	// Telegram rejects empty messages, which can happen when the model only
+	// emitted a tool call or its output was filtered
+	reply := renderReply(response)
+	if strings.TrimSpace(reply) == "" {
+		logWarn("[%s] LLM returned empty content for chat %d, not sending a reply", options.RequestID, chat.ID)
+		return
+	}
+
+	// Keep the reply in context so the conversation carries on as if it
+	// had been sent
+	if config.DryRun {
+		logInfo("[%s] Dry run, not sending reply to chat %d: %q", options.RequestID, chat.ID, reply)
+		context.Mutex.Lock()
+		addToContext(context, config, config.assistantName(context.Persona), response, true)
+		context.LastReplyAt = time.Now()
+		context.Mutex.Unlock()
+		return
+	}
+
+	// Still "typing" during the delay
+	if delay := humanDelay(config.HumanDelay, reply); delay > 0 {
+		logDebug("[%s] Delaying reply to chat %d by %v", options.RequestID, chat.ID, delay)
+		time.Sleep(delay)
+	}
+	stopTyping()
+
+	for _, part := range splitMessage(reply, config.MessageLimit) {
+		_, err = sendReply(bot, chat, config, part, sendOptions)
+		if err != nil {
+			logError("[%s] Telegram send error for chat %d: %v", options.RequestID, chat.ID, err)
+			untrackIfUnreachable(contextManager, status, chat, err)
+			return
+		}
+		// Only the first part quotes the triggering message
+		sendOptions.ReplyTo = nil
+	}
+
+	// The reply is stored with its interest tag so the model keeps seeing
+	// (and following) the format it was asked for
+	context.Mutex.Lock()
+	addToContext(context, config, config.assistantName(context.Persona), response, true)
+	context.LastReplyAt = time.Now()
+	context.Mutex.Unlock()
+}
+
+// completeWithRetry requests a reply, retrying once with less history when
+// the request was too long for the model. The latest keep messages (the
+// batch being answered) always stay.
+func completeWithRetry(context *ConversationContext, config Config, provider LLMProvider, chat *telebot.Chat, messages []OpenAIMessage, options RequestOptions, name string, keep int) (Completion, error) {
+	releaseSlot := acquireRequestSlot(options.RequestID, chat)
+	completion, err := completeReply(provider, config, chat, messages, options, name)
+	releaseSlot()
+	recordUsage(context, completion.Usage)
+
+	retryMessages, ok := shrinkForRetry(context, config, provider, chat, options, err, keep)
+	if !ok {
+		return completion, err
+	}
+	releaseSlot = acquireRequestSlot(options.RequestID, chat)
+	completion, err = completeReply(provider, config, chat, retryMessages, options, name)
+	releaseSlot()
+	recordUsage(context, completion.Usage)
+	return completion, err
+}
+
+// shrinkForRetry cuts back the history by context_overflow_strategy when err
+// is the request being too long for the model, returning the messages to
+// retry with. It reports false when there's nothing to retry.
+func shrinkForRetry(context *ConversationContext, config Config, provider LLMProvider, chat *telebot.Chat, options RequestOptions, err error, keep int) ([]OpenAIMessage, bool) {
+	if !isContextLengthError(err) || config.ContextOverflowStrategy == "none" {
+		return nil, false
+	}
+	logWarn("[%s] Request for chat %d is too long for the model, retrying with less history (%s)", options.RequestID, chat.ID, config.ContextOverflowStrategy)
+	if !shrinkContext(context, config, provider, chat, keep) {
+		return nil, false
+	}
+	context.Mutex.Lock()
+	defer context.Mutex.Unlock()
+	return formatMessagesForContext(context, config, chat), true
+}
+
+// shrinkContext cuts back a conversation whose request was too long for the
+// model, following context_overflow_strategy. The latest keep messages (the
+// batch being answered) always stay. It reports whether anything was cut.
+func shrinkContext(context *ConversationContext, config Config, provider LLMProvider, chat *telebot.Chat, keep int) bool {
+	if config.ContextOverflowStrategy == "summarize" {
+		count, err := summarizeContext(context, config, provider, chat)
+		if err == nil {
+			logInfo("Summarized %d messages in chat %d to fit the model's context", count, chat.ID)
+			return true
+		}
+		// The summary request may be too long itself
+		logWarn("Failed to summarize chat %d to fit the model's context, dropping older messages instead: %v", chat.ID, err)
+	}
+
+	context.Mutex.Lock()
+	defer context.Mutex.Unlock()
+
+	drop := max(len(context.Messages)-keep, 0)
+	if config.ContextOverflowStrategy != "pending" {
+		drop = (drop + 1) / 2
+	}
+	if drop == 0 {
+		return false
+	}
+	context.Messages = slices.Delete(context.Messages, 0, drop)
+	logInfo("Dropped the oldest %d messages in chat %d to fit the model's context", drop, chat.ID)
+	return true
+}
+
+// maxContinuations caps the follow-up requests auto_continue makes for one
+// reply
+const maxContinuations = 3
+
+// continuePrompt asks the model to finish a reply that was cut off
+const continuePrompt = "Your last message was cut off. Continue exactly where you left off, without repeating anything."
+
+// completeReply requests a reply and, with auto_continue, asks for more
+// while it was cut off at the token limit, joining the parts. A failed
+// continuation keeps the reply so far. name is the assistant's name, which
+// a continuation may repeat as a prefix.
+func completeReply(provider LLMProvider, config Config, chat *telebot.Chat, messages []OpenAIMessage, options RequestOptions, name string) (Completion, error) {
+	completion, err := provider.Complete(messages, options)
+	if err != nil || !config.AutoContinue {
+		return completion, err
+	}
+
+	for i := 1; i <= maxContinuations && completion.FinishReason == "length"; i++ {
+		logInfo("[%s] Reply for chat %d was cut off, asking for more (%d/%d)", options.RequestID, chat.ID, i, maxContinuations)
+
+		followUp := append(slices.Clone(messages),
+			OpenAIMessage{Role: "assistant", Content: completion.Content},
+			OpenAIMessage{Role: "user", Content: continuePrompt},
+		)
+		next, err := provider.Complete(followUp, options)
+		completion.Usage.add(next.Usage)
+		if err != nil {
+			logWarn("[%s] Continuation for chat %d failed, sending the reply so far: %v", options.RequestID, chat.ID, err)
+			break
+		}
+		completion.Content = joinContinuation(completion.Content, next.Content, name)
+		completion.FinishReason = next.FinishReason
+	}
+
+	return completion, nil
+}
+
+// joinContinuation appends a continuation to a cut-off reply. The model
+// usually picks up mid-sentence, so its text is appended as is, whitespace
+// included. A continuation that starts over with an interest tag or "name:"
+// is a fresh start: the tag and prefix are dropped and it's separated from
+// the reply so far.
+func joinContinuation(reply string, continuation string, name string) string {
+	_, stripped := parseInterest(stripSpeakerPrefix(continuation, name))
+	if stripped == continuation {
+		return reply + continuation
+	}
+	last, _ := utf8.DecodeLastRuneInString(reply)
+	if reply == "" || stripped == "" || unicode.IsSpace(last) {
+		return reply + stripped
+	}
+	return reply + " " + stripped
+}
+
+// interestPattern matches the leading interest tag the system prompt asks
+// for, either bracketed ("[High]") or as a bare uppercase word ("HIGH")
+var interestPattern = regexp.MustCompile(`^\s*(?:\[\s*((?i)HIGH|MEDIUM|LOW)\s*\]|(HIGH|MEDIUM|LOW)\b)\s*[:\-]?\s*`)
+
+// speakerPrefixPattern matches a "frank:" (or whatever the assistant is
+// called) that the model wrote before its reply despite being told not to,
+// including markdown bold around the name
+func speakerPrefixPattern(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)^\s*\**(?:frank|` + regexp.QuoteMeta(name) + `)\**\s*:\s*(?:\*\*\s*)?`)
+}
+
+// stripSpeakerPrefix removes a leading "name:" from a response, whether it
+// comes before or after the interest tag
+func stripSpeakerPrefix(response string, name string) string {
+	pattern := speakerPrefixPattern(name)
+	response = pattern.ReplaceAllString(response, "")
+	tag := interestPattern.FindString(response)
+	return tag + pattern.ReplaceAllString(response[len(tag):], "")
+}
+
+// interestLevels orders the interest levels from least to most interested
+var interestLevels = map[string]int{"LOW": 1, "MEDIUM": 2, "HIGH": 3}
+
+// parseInterest splits a leading interest tag from a response, returning the
+// upper-cased level ("" if there is no tag) and the remaining text
+func parseInterest(response string) (string, string) {
+	match := interestPattern.FindStringSubmatch(response)
+	if match == nil {
+		return "", response
+	}
+	level := match[1]
+	if level == "" {
+		level = match[2]
+	}
+	return strings.ToUpper(level), response[len(match[0]):]
+}
+
+// interestAtLeast reports whether level meets the minimum interest level
+func interestAtLeast(level string, minimum string) bool {
+	return interestLevels[level] >= interestLevels[strings.ToUpper(minimum)]
+}
+
+// recordInterest stores the interest level of a response on the context and
+// reports whether it is high enough for Frank to reply
+func recordInterest(context *ConversationContext, config Config, chat *telebot.Chat, response string) bool {
+	level, _ := parseInterest(response)
+	if level == "" {
+		return true
+	}
+
+	context.Mutex.Lock()
+	context.LastInterest = level
+	if context.InterestCounts == nil {
+		context.InterestCounts = make(map[string]int)
+	}
+	context.InterestCounts[level]++
+	context.Mutex.Unlock()
+
+	if !interestAtLeast(level, config.MinInterest) {
+		logInfo("Interest %s in chat %d is below min_interest %s, staying quiet", level, chat.ID, config.MinInterest)
+		return false
+	}
+	return true
+}
+
+// SendLimiter paces outgoing messages to stay within Telegram's limits of
+// about one message a second per chat and 30 a second overall
+type SendLimiter struct {
+	global *rate.Limiter
+	chats  map[int64]*rate.Limiter
+	mutex  sync.Mutex
+}
+
+func NewSendLimiter() *SendLimiter {
+	return &SendLimiter{
+		global: rate.NewLimiter(30, 30),
+		chats:  make(map[int64]*rate.Limiter),
+	}
+}
+
+// wait blocks until a message may be sent to chatID
+func (l *SendLimiter) wait(chatID int64) {
+	l.mutex.Lock()
+	chat, exists := l.chats[chatID]
+	if !exists {
+		chat = rate.NewLimiter(rate.Every(time.Second), 1)
+		l.chats[chatID] = chat
+	}
+	delay := max(chat.Reserve().Delay(), l.global.Reserve().Delay())
+	l.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+// sendLimits is shared by every send and edit the bot makes to a chat
+var sendLimits = NewSendLimiter()
+
+// replyTrackerSize is how many of Frank's recent replies are remembered per
+// chat so reactions to them can be matched
+const replyTrackerSize = 100
+
+// sentReply is one of Frank's messages as it was last sent or edited
+type sentReply struct {
+	MessageID int
+	Text      string
+}
+
+// ReplyTracker remembers Frank's recent replies in each chat
+type ReplyTracker struct {
+	chats map[int64][]sentReply
+	mutex sync.Mutex
+}
+
+// NewReplyTracker creates an empty reply tracker
+func NewReplyTracker() *ReplyTracker {
+	return &ReplyTracker{chats: make(map[int64][]sentReply)}
+}
+
+// record stores a reply's text, replacing it if the message was edited
+func (rt *ReplyTracker) record(chatID int64, messageID int, text string) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	replies := rt.chats[chatID]
+	for i := range replies {
+		if replies[i].MessageID == messageID {
+			replies[i].Text = text
+			return
+		}
+	}
+	replies = append(replies, sentReply{MessageID: messageID, Text: text})
+	if len(replies) > replyTrackerSize {
+		replies = replies[len(replies)-replyTrackerSize:]
+	}
+	rt.chats[chatID] = replies
+}
+
+// lookup returns the text of one of Frank's replies, if it's still remembered
+func (rt *ReplyTracker) lookup(chatID int64, messageID int) (string, bool) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	for _, reply := range rt.chats[chatID] {
+		if reply.MessageID == messageID {
+			return reply.Text, true
+		}
+	}
+	return "", false
+}
+
+// sentReplies tracks every reply sent through sendReply and editReply
+var sentReplies = NewReplyTracker()
+
+// FeedbackRecord is one line of the feedback log
+type FeedbackRecord struct {
+	Time      time.Time `json:"time"`
+	ChatID    int64     `json:"chat_id"`
+	MessageID int       `json:"message_id"`
+	UserID    int64     `json:"user_id,omitempty"`
+	Reaction  string    `json:"reaction"`
+	Reply     string    `json:"reply"`
+}
+
+// feedbackMutex keeps concurrent writes to the feedback log from interleaving
+var feedbackMutex sync.Mutex
+
+// appendFeedback writes a record to the feedback log as a line of JSON
+func appendFeedback(path string, record FeedbackRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshaling feedback: %v", err)
+	}
+
+	feedbackMutex.Lock()
+	defer feedbackMutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening feedback log: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing feedback log: %v", err)
+	}
+	return nil
+}
+
+// addedReactions returns the emoji in a reaction update that weren't there before
+func addedReactions(reaction *telebot.MessageReaction) []string {
+	old := make(map[string]bool)
+	for _, r := range reaction.OldReaction {
+		old[r.Emoji] = true
+	}
+
+	var added []string
+	for _, r := range reaction.NewReaction {
+		if r.Type == "emoji" && !old[r.Emoji] {
+			added = append(added, r.Emoji)
+		}
+	}
+	return added
+}
+
+// handleReaction counts 👍 and 👎 reactions to Frank's replies, and logs them
+// for later use as fine-tuning data if feedback_log_path is set
+func handleReaction(contextManager *ContextManager, config Config, reaction *telebot.MessageReaction) {
+	// Runs in its own goroutine, where a panic would take the bot down
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(r, "handling a reaction to message %d", reaction.MessageID)
+		}
+	}()
+
+	if reaction.Chat == nil {
+		return
+	}
+	chatID := reaction.Chat.ID
+
+	text, ok := sentReplies.lookup(chatID, reaction.MessageID)
+	if !ok {
+		return
+	}
+
+	var userID int64
+	if reaction.User != nil {
+		userID = reaction.User.ID
+	}
+
+	for _, emoji := range addedReactions(reaction) {
+		if emoji != "👍" && emoji != "👎" {
+			continue
+		}
+		logInfo("%s from user %d on reply %d in chat %d", emoji, userID, reaction.MessageID, chatID)
+
+		context := contextManager.getContext(reaction.Chat, 0)
+		context.Mutex.Lock()
+		if emoji == "👍" {
+			context.ThumbsUp++
+		} else {
+			context.ThumbsDown++
+		}
+		context.Mutex.Unlock()
+
+		if config.FeedbackLogPath != "" {
+			record := FeedbackRecord{
+				Time:      time.Now(),
+				ChatID:    chatID,
+				MessageID: reaction.MessageID,
+				UserID:    userID,
+				Reaction:  emoji,
+				Reply:     text,
+			}
+			if err := appendFeedback(config.FeedbackLogPath, record); err != nil {
+				logError("Error logging feedback for chat %d: %v", chatID, err)
+			}
+		}
+	}
+}
+
+// maxFloodRetries is how many times a send rejected with a flood error is
+// retried after the wait Telegram asks for
+const maxFloodRetries = 3
+
+// withFloodRetry waits for sendLimits and calls send, retrying after
+// Telegram's retry_after when it still reports flooding
+func withFloodRetry(chatID int64, send func() (*telebot.Message, error)) (*telebot.Message, error) {
+	for attempt := 0; ; attempt++ {
+		sendLimits.wait(chatID)
+
+		message, err := send()
+		if err == nil {
+			markAlive()
+		}
+		var flood telebot.FloodError
+		if !errors.As(err, &flood) || attempt >= maxFloodRetries {
+			return message, err
+		}
+
+		logWarn("Telegram flood limit hit for chat %d, retrying in %ds", chatID, flood.RetryAfter)
+		time.Sleep(time.Duration(flood.RetryAfter) * time.Second)
+	}
+}
+
+// sendThrottled is bot.Send, paced by sendLimits
+func sendThrottled(bot *telebot.Bot, chat *telebot.Chat, what interface{}, options ...interface{}) (*telebot.Message, error) {
+	return withFloodRetry(chat.ID, func() (*telebot.Message, error) {
+		return bot.Send(chat, what, options...)
+	})
+}
+
+// editThrottled is bot.Edit, paced by sendLimits
+func editThrottled(bot *telebot.Bot, message *telebot.Message, what interface{}, options ...interface{}) (*telebot.Message, error) {
+	return withFloodRetry(message.Chat.ID, func() (*telebot.Message, error) {
+		return bot.Edit(message, what, options...)
+	})
+}
+
+// isParseError reports whether Telegram rejected a message because its
+// markup was malformed
+func isParseError(err error) bool {
+	return strings.Contains(err.Error(), "can't parse entities")
+}
+
+// humanDelay picks how long to wait before sending reply: from the bottom
+// of the range for a short reply to the top for one of humanDelayFullLength
+// characters or more, with some random jitter
+func humanDelay(delays DelayRange, reply string) time.Duration {
+	if delays.MaxSeconds <= 0 {
+		return 0
+	}
+
+	scale := min(float64(utf8.RuneCountInString(reply))/humanDelayFullLength, 1)
+	jitter := 0.75 + rand.Float64()/2
+	seconds := delays.MinSeconds + (delays.MaxSeconds-delays.MinSeconds)*scale*jitter
+	seconds = max(delays.MinSeconds, min(seconds, delays.MaxSeconds))
 
-	return config, nil
+	return time.Duration(seconds * float64(time.Second))
 }
 
-func callOpenAI(config Config, messages []OpenAIMessage) (string, error) {
-	client := resty.New()
+// replyOptions builds the send options for a reply to a batch: replies go
+// to the batch's forum topic and, if configured, quote its last message
+func replyOptions(config Config, pending []Message) telebot.SendOptions {
+	var options telebot.SendOptions
 
-	request := OpenAIRequest{
-		Model:    config.OpenAIModel,
-		Messages: messages,
+	for i := len(pending) - 1; i >= 0; i-- {
+		source := pending[i].Source
+		if source == nil {
+			continue
+		}
+		options.ThreadID = source.ThreadID
+		if config.ReplyToMessage {
+			options.ReplyTo = source
+			// Still reply if the quoted message was deleted meanwhile
+			options.AllowWithoutReply = true
+		}
+		break
 	}
 
-	var response OpenAIResponse
+	return options
+}
 
-	resp, err := client.R().
-		SetHeader("Authorization", "Bearer "+config.OpenAIAPIKey).
-		SetHeader("Content-Type", "application/json").
-		SetBody(request).
-		SetResult(&response).
-		Post(config.OpenAIAPIURL)
+// sendReply sends text using the configured parse mode, falling back to
+// plain text when the model produced markup Telegram can't parse
+func sendReply(bot *telebot.Bot, chat *telebot.Chat, config Config, text string, options telebot.SendOptions) (*telebot.Message, error) {
+	options.ParseMode = telebot.ParseMode(config.ParseMode)
 
-	if err != nil {
-		return "", fmt.Errorf("HTTP request failed: %v", err)
+	sent, err := sendThrottled(bot, chat, text, &options)
+	if err != nil && options.ParseMode != "" && isParseError(err) {
+		logDebug("Reply for chat %d isn't valid %s, sending as plain text: %v", chat.ID, config.ParseMode, err)
+		options.ParseMode = telebot.ModeDefault
+		sent, err = sendThrottled(bot, chat, text, &options)
 	}
-
-	if resp.StatusCode() != 200 {
-		return "", fmt.Errorf("API returned status %d: %s", resp.StatusCode(), resp.String())
+	if err == nil {
+		sentReplies.record(chat.ID, sent.ID, text)
 	}
+	return sent, err
+}
 
-	if len(response.Choices) == 0 {
-		return "", fmt.Errorf("no choices in API response")
+// editReply is sendReply for editing an existing message
+func editReply(bot *telebot.Bot, message *telebot.Message, config Config, text string) (*telebot.Message, error) {
+	options := &telebot.SendOptions{ParseMode: telebot.ParseMode(config.ParseMode)}
+	edited, err := editThrottled(bot, message, text, options)
+	if err != nil && options.ParseMode != "" && isParseError(err) {
+		logDebug("Reply for chat %d isn't valid %s, editing as plain text: %v", message.Chat.ID, config.ParseMode, err)
+		edited, err = editThrottled(bot, message, text)
 	}
-
-	return response.Choices[0].Message.Content, nil
+	if err == nil {
+		sentReplies.record(message.Chat.ID, message.ID, text)
+	}
+	return edited, err
 }
 
-func formatMessagesForContext(context *ConversationContext) []OpenAIMessage {
-	var openAIMessages []OpenAIMessage
-
-	openAIMessages = append(openAIMessages, OpenAIMessage{
-		Role:    "system",
-		Content: context.SystemMessage,
-	})
-
-	for _, msg := range context.Messages {
-		if msg.IsBot {
-			openAIMessages = append(openAIMessages, OpenAIMessage{
-				Role:    "assistant",
-				Content: msg.Text,
-			})
-		} else {
-			openAIMessages = append(openAIMessages, OpenAIMessage{
-				Role:    "user",
-				Content: fmt.Sprintf("%s: %s", msg.Username, msg.Text),
-			})
+// isChatUnreachable reports whether a Telegram send error means the bot can
+// never talk to the chat again, e.g. it was blocked or removed
+func isChatUnreachable(err error) bool {
+	for _, unreachable := range []error{
+		telebot.ErrBlockedByUser,
+		telebot.ErrKickedFromGroup,
+		telebot.ErrKickedFromSuperGroup,
+		telebot.ErrChatNotFound,
+		telebot.ErrNotStartedByUser,
+		telebot.ErrUserIsDeactivated,
+	} {
+		if errors.Is(err, unreachable) {
+			return true
 		}
 	}
 
-	for _, msg := range context.PendingMessages {
-		openAIMessages = append(openAIMessages, OpenAIMessage{
-			Role:    "user",
-			Content: fmt.Sprintf("%s: %s", msg.Username, msg.Text),
-		})
+	// Fall back to the description for errors telebot doesn't map
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "bot was blocked") ||
+		strings.Contains(message, "bot was kicked") ||
+		strings.Contains(message, "chat not found")
+}
+
+// untrackIfUnreachable stops tracking a chat and drops its context when a
+// send error shows the bot can no longer reach it
+func untrackIfUnreachable(contextManager *ContextManager, status *BotStatus, chat *telebot.Chat, err error) bool {
+	if !isChatUnreachable(err) {
+		return false
 	}
 
-	return openAIMessages
+	logWarn("Chat %d is unreachable, removing it from tracking: %v", chat.ID, err)
+	contextManager.clearContext(chat.ID)
+	status.removeChatID(chat.ID)
+	return true
 }
 
-func trimContext(context *ConversationContext, maxChars int) {
-	for {
-		totalChars := 0
+// typingInterval is how often the typing indicator is refreshed; Telegram
+// clears it after about five seconds
+const typingInterval = 4 * time.Second
 
-		for _, msg := range context.Messages {
-			if msg.IsBot {
-				totalChars += len(msg.Text)
-			} else {
-				totalChars += len(fmt.Sprintf("%s: %s", msg.Username, msg.Text))
+// humanDelayFullLength is the reply length, in characters, that gets the
+// longest human_delay
+const humanDelayFullLength = 500
+
+// keepTyping shows the typing indicator in chat until the returned function
+// is called. The stop function is safe to call more than once.
+func keepTyping(bot *telebot.Bot, chat *telebot.Chat) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(typingInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := bot.Notify(chat, telebot.Typing); err != nil {
+				logDebug("Failed to send typing indicator to chat %d: %v", chat.ID, err)
 			}
-		}
 
-		if totalChars <= maxChars || len(context.Messages) == 0 {
-			break
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
 		}
+	}()
 
-		context.Messages = context.Messages[1:]
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
 	}
 }
 
-func addToContext(context *ConversationContext, username string, text string, isBot bool) {
-	message := Message{
-		Username:  username,
-		Text:      text,
-		Timestamp: time.Now(),
-		IsBot:     isBot,
+// notifyError lets the chat know when a reply was lost to a timeout rather
+// than leaving everyone waiting in silence. With report_errors_to_chat other
+// failures are reported too, at most once per cooldown.
+func notifyError(bot *telebot.Bot, chat *telebot.Chat, context *ConversationContext, config Config, err error) {
+	notice := "⏱️ Sorry, the model took too long to respond."
+	if !errors.Is(err, errRequestTimeout) {
+		if !config.ReportErrorsToChat {
+			return
+		}
+
+		context.Mutex.Lock()
+		sendNotice := time.Since(context.LastErrorNoticeAt) >= rateLimitNoticeCooldown
+		if sendNotice {
+			context.LastErrorNoticeAt = time.Now()
+		}
+		context.Mutex.Unlock()
+		if !sendNotice {
+			return
+		}
+
+		notice = "⚠️ LLM error: " + describeError(err)
 	}
 
-	context.Messages = append(context.Messages, message)
-	trimContext(context, 8000)
+	if _, err := sendThrottled(bot, chat, notice); err != nil {
+		logError("Failed to send error notice to chat %d: %v", chat.ID, err)
+	}
 }
 
-func loadBotStatus() (*BotStatus, error) {
-	status := &BotStatus{
-		ChatIDs: []int64{},
+// describeError summarises an API failure for the chat without exposing
+// response bodies, URLs or keys
+func describeError(err error) string {
+	if isContextLengthError(err) {
+		return "the conversation is too long for the model, try FRANK RESET"
 	}
 
-	file, err := os.Open("status.json")
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Println("status.json does not exist, will create on first chat interaction")
-			return status, nil
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			return "rate limited by the API, try again in a bit"
+		case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+			return "the API rejected the bot's credentials"
+		case apiErr.StatusCode >= 500:
+			return fmt.Sprintf("the API is having problems (status %d)", apiErr.StatusCode)
 		}
-		return status, fmt.Errorf("failed to open status.json: %v", err)
+		return fmt.Sprintf("the API refused the request (status %d)", apiErr.StatusCode)
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(status)
-	if err != nil {
-		return status, fmt.Errorf("failed to parse status.json: %v", err)
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "couldn't reach the API"
 	}
-
-	log.Printf("Loaded status.json with %d chat IDs", len(status.ChatIDs))
-	return status, nil
+	return "the API returned something unexpected"
 }
 
-func (s *BotStatus) addChatID(chatID int64) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// streamResponse streams a completion into the chat, sending a message on the
+// first chunk and editing it as more text arrives, and returns the reply with
+// the request's usage. On error it returns the text that did reach the chat,
+// if any.
+func streamResponse(bot *telebot.Bot, chat *telebot.Chat, config Config, streamer StreamingProvider, openAIMessages []OpenAIMessage, options RequestOptions, sendOptions telebot.SendOptions, render func(string) string) (string, Usage, error) {
+	var sent *telebot.Message
+	var partial strings.Builder
+	var lastText string
+	var lastEdit time.Time
+	var sendErr error
 
-	for _, id := range s.ChatIDs {
-		if id == chatID {
-			return nil
+	// The live message only ever shows the first part of the reply; any
+	// overflow is sent as follow-up messages once the stream completes
+	update := func(text string) {
+		parts := splitMessage(render(text), config.MessageLimit)
+		if len(parts) == 0 {
+			return
+		}
+		text = parts[0]
+		if text == lastText {
+			return
 		}
-	}
-
-	s.ChatIDs = append(s.ChatIDs, chatID)
-	log.Printf("New chat added: %d (total: %d chats)", chatID, len(s.ChatIDs))
-	return s.save()
-}
-
-func (s *BotStatus) removeChatID(chatID int64) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
 
-	for i, id := range s.ChatIDs {
-		if id == chatID {
-			s.ChatIDs = append(s.ChatIDs[:i], s.ChatIDs[i+1:]...)
-			return s.save()
+		var err error
+		if sent == nil {
+			sent, err = sendReply(bot, chat, config, text, sendOptions)
+		} else {
+			_, err = editReply(bot, sent, config, text)
 		}
+		if err != nil {
+			logError("Telegram streaming update error for chat %d: %v", chat.ID, err)
+			sendErr = err
+			return
+		}
+		lastText = text
 	}
 
-	return nil
-}
-
-func (s *BotStatus) save() error {
-	file, err := os.Create("status.json")
+	response, usage, err := streamer.Stream(openAIMessages, options, func(chunk string) {
+		partial.WriteString(chunk)
+		// Wait for enough text that a leading interest tag is complete
+		if partial.Len() < streamMinDisplayBytes || time.Since(lastEdit) < streamEditInterval {
+			return
+		}
+		lastEdit = time.Now()
+		update(partial.String())
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create status.json: %v", err)
+		return lastText, usage, err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(s)
-	if err != nil {
-		return fmt.Errorf("failed to write status.json: %v", err)
+	// Nothing to show, e.g. Frank wasn't interested enough to reply
+	parts := splitMessage(render(response), config.MessageLimit)
+	if len(parts) == 0 {
+		return response, usage, nil
 	}
 
-	log.Printf("Saved status.json with %d chat IDs", len(s.ChatIDs))
-	return nil
-}
+	update(response)
+	if lastText != parts[0] {
+		return lastText, usage, fmt.Errorf("failed to deliver streamed response: %w", sendErr)
+	}
 
-func sendStartupNotifications(bot *telebot.Bot, status *BotStatus, config Config) {
-	// Skip notifications if message is empty
-	if config.StartupMessage == "" {
-		log.Println("Startup message is empty, skipping notifications")
-		return
+	sendOptions.ReplyTo = nil
+	delivered := lastText
+	for _, part := range parts[1:] {
+		if _, err := sendReply(bot, chat, config, part, sendOptions); err != nil {
+			return delivered, usage, fmt.Errorf("failed to send remainder of streamed response: %w", err)
+		}
+		delivered += "\n" + part
 	}
 
-	status.mutex.Lock()
-	chatIDs := make([]int64, len(status.ChatIDs))
-	copy(chatIDs, status.ChatIDs)
-	status.mutex.Unlock()
+	return response, usage, nil
+}
 
-	if len(chatIDs) == 0 {
-		log.Println("No chats to send startup notifications to")
-		return
-	}
+// proactiveCheckInterval is how often quiet chats are checked for a
+// conversation starter
+const proactiveCheckInterval = time.Minute
 
-	log.Printf("Sending startup notifications to %d chats", len(chatIDs))
+// proactivePrompt asks the model for a conversation starter
+const proactivePrompt = "The chat has been quiet for a while. Say something to get the conversation going again, in character, as a single short message."
 
-	for _, chatID := range chatIDs {
-		chat := &telebot.Chat{ID: chatID}
-		_, err := bot.Send(chat, config.StartupMessage)
-		if err != nil {
-			log.Printf("Failed to send startup message to chat %d: %v", chatID, err)
-			status.removeChatID(chatID)
-		} else {
-			log.Printf("Sent startup notification to chat %d", chatID)
-		}
+// inActiveHours reports whether hour falls in [start, end), wrapping past
+// midnight when start is after end
+func inActiveHours(hour int, start int, end int) bool {
+	if start <= end {
+		return hour >= start && hour < end
 	}
+	return hour >= start || hour < end
 }
 
-func handleChatMember(bot *telebot.Bot, status *BotStatus, contextManager *ContextManager, update *telebot.ChatMemberUpdate) {
-	log.Printf("Chat member update received: user %d in chat %d", update.NewChatMember.User.ID, update.Chat.ID)
+// runProactive periodically lets Frank break the silence in tracked chats
+// that have been idle for proactive_idle_minutes. He only does so once per
+// silence: someone has to speak before he starts another conversation.
+func runProactive(bot *telebot.Bot, contextManager *ContextManager, config Config, provider LLMProvider, status *BotStatus) {
+	idle := time.Duration(config.ProactiveIdleMinutes) * time.Minute
+	cooldown := max(idle, time.Duration(config.MinReplyIntervalSeconds)*time.Second)
 
-	if update.NewChatMember.User.ID == bot.Me.ID {
-		log.Printf("Bot membership changed in chat %d, role: %s", update.Chat.ID, update.NewChatMember.Role)
+	for range time.Tick(proactiveCheckInterval) {
+		if !inActiveHours(time.Now().In(config.location()).Hour(), *config.ProactiveStartHour, *config.ProactiveEndHour) {
+			continue
+		}
 
-		switch update.NewChatMember.Role {
-		case telebot.Member, telebot.Administrator, telebot.Creator:
-			log.Printf("Bot added to chat %d", update.Chat.ID)
-			err := status.addChatID(update.Chat.ID)
-			if err != nil {
-				log.Printf("Failed to add chat ID %d: %v", update.Chat.ID, err)
-			} else {
-				log.Printf("Successfully added chat ID %d to status", update.Chat.ID)
+		for _, key := range contextManager.keys() {
+			if !status.isTracked(key.ChatID) || status.chatSettings(key.ChatID).Muted {
+				continue
 			}
-		case telebot.Left, telebot.Kicked:
-			log.Printf("Bot removed from chat %d", update.Chat.ID)
-			// Clear the context for this chat
-			contextManager.clearContext(update.Chat.ID)
-			err := status.removeChatID(update.Chat.ID)
-			if err != nil {
-				log.Printf("Failed to remove chat ID %d: %v", update.Chat.ID, err)
-			} else {
-				log.Printf("Successfully removed chat ID %d from status", update.Chat.ID)
+			context := contextManager.lookupContext(key.ChatID, key.ThreadID)
+			if context == nil {
+				continue
+			}
+
+			context.Mutex.Lock()
+			due := context.Chat != nil &&
+				len(context.PendingMessages) == 0 &&
+				time.Since(context.LastMessageTime) >= idle &&
+				time.Since(context.LastReplyAt) >= cooldown &&
+				context.LastMessageTime.After(context.LastProactiveAt)
+			chat := context.Chat
+			context.Mutex.Unlock()
+
+			if due {
+				startConversation(bot, chat, key.ThreadID, contextManager, config, provider, status)
 			}
 		}
 	}
 }
 
-func handleFrankCommand(bot *telebot.Bot, status *BotStatus, m *telebot.Message) {
-	command := strings.ToUpper(strings.TrimSpace(m.Text))
-	chatID := m.Chat.ID
-
-	log.Printf("Received FRANK command: '%s' from chat %d", command, chatID)
-
-	switch command {
-	case "FRANK STOP":
-		err := status.removeChatID(chatID)
-		if err != nil {
-			log.Printf("Failed to remove chat ID %d: %v", chatID, err)
-			bot.Send(m.Chat, "❌ Failed to remove chat from tracking")
-		} else {
-			log.Printf("Chat %d removed from tracking via FRANK STOP command", chatID)
-			bot.Send(m.Chat, "✅ Chat removed from tracking - bot will no longer send startup notifications here")
-		}
+// startConversation asks the model for a conversation starter and sends it,
+// in the given forum topic if there is one
+func startConversation(bot *telebot.Bot, chat *telebot.Chat, threadID int, contextManager *ContextManager, config Config, provider LLMProvider, status *BotStatus) {
+	context := contextManager.getContext(chat, threadID)
 
-	case "FRANK START":
-		err := status.addChatID(chatID)
-		if err != nil {
-			log.Printf("Failed to add chat ID %d: %v", chatID, err)
-			bot.Send(m.Chat, "❌ Failed to add chat to tracking")
-		} else {
-			log.Printf("Chat %d added to tracking via FRANK START command", chatID)
-			bot.Send(m.Chat, "✅ Chat added to tracking - bot will send startup notifications here")
-		}
+	context.Mutex.Lock()
+	openAIMessages := formatMessagesForContext(context, config, chat)
+	options := RequestOptions{Model: context.Model, Temperature: context.Temperature, RequestID: newRequestID()}
+	name := config.assistantName(context.Persona)
+	// Marked before the call so a failure isn't retried every minute
+	context.LastProactiveAt = time.Now()
+	context.Mutex.Unlock()
 
-	default:
-		log.Printf("Unknown FRANK command: '%s'", command)
-		bot.Send(m.Chat, "❓ Unknown command. Available commands:\n• FRANK STOP - Remove chat from tracking\n• FRANK START - Add chat to tracking")
-	}
-}
+	openAIMessages = append(openAIMessages, OpenAIMessage{Role: "system", Content: proactivePrompt})
 
-func handleIncomingMessage(bot *telebot.Bot, contextManager *ContextManager, config Config, status *BotStatus, m *telebot.Message) {
-	if m.Text == "" || strings.TrimSpace(m.Text) == "" {
+	if !allowRequest(bot, chat, context, config) {
 		return
 	}
 
-	if m.Sender.ID == bot.Me.ID {
+	logInfo("[%s] Chat %d has been quiet, starting a conversation", options.RequestID, chat.ID)
+
+	releaseSlot := acquireRequestSlot(options.RequestID, chat)
+	completion, err := provider.Complete(openAIMessages, options)
+	releaseSlot()
+	llmBreaker.record(err)
+	recordUsage(context, completion.Usage)
+	if err != nil {
+		logError("[%s] LLM API error for chat %d: %v", options.RequestID, chat.ID, err)
 		return
 	}
+	logDebug("[%s] Response for chat %d: %q", options.RequestID, chat.ID, completion.Content)
+	response := completion.Content
 
-	// Check for FRANK commands
-	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(m.Text)), "FRANK ") {
-		handleFrankCommand(bot, status, m)
+	_, reply := parseInterest(stripSpeakerPrefix(response, name))
+	if strings.TrimSpace(reply) == "" {
+		logWarn("[%s] LLM returned empty content for chat %d, not sending a reply", options.RequestID, chat.ID)
 		return
 	}
 
-	// Check if this chat is in our tracking list
-	status.mutex.Lock()
-	isTracked := false
-	for _, id := range status.ChatIDs {
-		if id == m.Chat.ID {
-			isTracked = true
-			break
+	if config.DryRun {
+		logInfo("[%s] Dry run, not sending conversation starter to chat %d: %q", options.RequestID, chat.ID, reply)
+	} else {
+		for _, part := range splitMessage(reply, config.MessageLimit) {
+			if _, err := sendReply(bot, chat, config, part, telebot.SendOptions{ThreadID: threadID}); err != nil {
+				logError("[%s] Telegram send error for chat %d: %v", options.RequestID, chat.ID, err)
+				untrackIfUnreachable(contextManager, status, chat, err)
+				return
+			}
 		}
 	}
-	status.mutex.Unlock()
 
-	if !isTracked {
-		log.Printf("Ignoring message from untracked chat %d (%s)", m.Chat.ID, m.Chat.Title)
-		return
-	}
+	context.Mutex.Lock()
+	addToContext(context, config, config.assistantName(context.Persona), response, true)
+	context.LastReplyAt = time.Now()
+	context.Mutex.Unlock()
+}
 
-	log.Printf("Processing message from tracked chat %d (%s)", m.Chat.ID, m.Chat.Title)
+// lastAlive is when Telegram last answered us (Unix nanoseconds): an update
+// arrived, a send succeeded or a heartbeat got through
+var lastAlive atomic.Int64
 
-	// Get the context for THIS specific chat
-	context := contextManager.getContext(m.Chat.ID)
-	
-	context.Mutex.Lock()
-	defer context.Mutex.Unlock()
+func markAlive() {
+	lastAlive.Store(time.Now().UnixNano())
+}
+
+// heartbeatInterval is how often Telegram is pinged so a quiet bot still
+// shows as healthy; healthStaleAfter is how long without contact before
+// /healthz reports the bot as unhealthy
+const (
+	heartbeatInterval = 30 * time.Second
+	healthStaleAfter  = 2 * time.Minute
+)
 
-	username := m.Sender.Username
-	if username == "" {
-		username = m.Sender.FirstName
-		if m.Sender.LastName != "" {
-			username += " " + m.Sender.LastName
+// runHeartbeat calls getMe every heartbeatInterval to check Telegram is
+// reachable
+func runHeartbeat(bot *telebot.Bot) {
+	for range time.Tick(heartbeatInterval) {
+		if _, err := bot.Raw("getMe", nil); err != nil {
+			logWarn("Telegram heartbeat failed: %v", err)
+			continue
 		}
+		markAlive()
 	}
+}
 
-	message := Message{
-		Username:  username,
-		Text:      m.Text,
-		Timestamp: time.Now(),
-		IsBot:     false,
+// serveHealth serves /healthz on addr: 200 while Telegram has answered
+// within healthStaleAfter, 503 after that
+func serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		since := time.Since(time.Unix(0, lastAlive.Load())).Round(time.Second)
+		if since > healthStaleAfter {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "no contact with Telegram for %v\n", since)
+			return
+		}
+		fmt.Fprintf(w, "ok, last contact with Telegram %v ago\n", since)
+	})
+
+	logInfo("Serving health checks on %s/healthz", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logError("Health check server failed: %v", err)
 	}
+}
 
-	context.PendingMessages = append(context.PendingMessages, message)
+// Delays between attempts to reach Telegram, doubling from the first to
+// the most
+const (
+	reconnectFirstDelay = time.Second
+	reconnectMaxDelay   = time.Minute
+)
 
-	if context.Timer != nil {
-		context.Timer.Stop()
+// nextReconnectDelay doubles the previous delay, starting from
+// reconnectFirstDelay and capped at reconnectMaxDelay
+func nextReconnectDelay(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return reconnectFirstDelay
 	}
-
-	// Pass contextManager instead of context to processBatch
-	context.Timer = time.AfterFunc(10*time.Second, func() {
-		processBatch(bot, m.Chat, contextManager, config)
-	})
+	return min(previous*2, reconnectMaxDelay)
 }
 
-func processBatch(bot *telebot.Bot, chat *telebot.Chat, contextManager *ContextManager, config Config) {
-	// Get the context for THIS specific chat
-	context := contextManager.getContext(chat.ID)
-	
-	context.Mutex.Lock()
+// isFatalTelegramError reports whether err means retrying can't help, i.e.
+// the bot token is wrong
+func isFatalTelegramError(err error) bool {
+	return errors.Is(err, telebot.ErrUnauthorized) || errors.Is(err, telebot.ErrNotFound)
+}
 
-	if len(context.PendingMessages) == 0 {
-		context.Mutex.Unlock()
-		return
+// newBotWithRetry creates the bot, retrying with backoff while Telegram
+// can't be reached. A rejected token is returned straight away.
+func newBotWithRetry(pref telebot.Settings) (*telebot.Bot, error) {
+	var delay time.Duration
+	for {
+		bot, err := telebot.NewBot(pref)
+		if err == nil || isFatalTelegramError(err) {
+			return bot, err
+		}
+		delay = nextReconnectDelay(delay)
+		logWarn("Failed to reach Telegram, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
 	}
+}
 
-	for _, msg := range context.PendingMessages {
-		context.Messages = append(context.Messages, msg)
-	}
+// ReconnectingPoller long polls like telebot.LongPoller, but backs off
+// while Telegram is unreachable instead of retrying in a tight loop, and
+// stops the bot if the token is rejected
+type ReconnectingPoller struct {
+	Timeout        time.Duration
+	AllowedUpdates []string
+	// Err is why polling gave up, once the bot has stopped
+	Err          error
+	lastUpdateID int
+}
 
-	openAIMessages := formatMessagesForContext(context)
-	context.PendingMessages = []Message{}
-	context.Timer = nil
+func (p *ReconnectingPoller) Poll(b *telebot.Bot, dest chan telebot.Update, stop chan struct{}) {
+	var delay time.Duration
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
 
-	context.Mutex.Unlock()
+		updates, err := p.getUpdates(b)
+		if err != nil {
+			if isFatalTelegramError(err) {
+				logError("Telegram rejected the bot token, shutting down: %v", err)
+				p.Err = err
+				// Stop waits for Poll to return, so it can't be called
+				// from here directly
+				go b.Stop()
+				<-stop
+				return
+			}
+			delay = nextReconnectDelay(delay)
+			logWarn("Failed to get updates, retrying in %v: %v", delay, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		if delay > 0 {
+			logInfo("Reconnected to Telegram")
+			delay = 0
+		}
 
-	bot.Notify(chat, telebot.Typing)
+		for _, update := range updates {
+			p.lastUpdateID = update.ID
+			dest <- update
+		}
+	}
+}
 
-	response, err := callOpenAI(config, openAIMessages)
+// getUpdates fetches the updates after the last one seen
+func (p *ReconnectingPoller) getUpdates(b *telebot.Bot) ([]telebot.Update, error) {
+	data, err := b.Raw("getUpdates", map[string]interface{}{
+		"offset":          p.lastUpdateID + 1,
+		"timeout":         int(p.Timeout / time.Second),
+		"allowed_updates": p.AllowedUpdates,
+	})
 	if err != nil {
-		log.Printf("OpenAI API error for chat %d: %v", chat.ID, err)
-		return
+		return nil, err
 	}
 
-	if len(response) > 4096 {
-		response = response[:4096]
+	var response struct {
+		Result []telebot.Update `json:"result"`
 	}
-
-	_, err = bot.Send(chat, response)
-	if err != nil {
-		log.Printf("Telegram send error for chat %d: %v", chat.ID, err)
-		return
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("error parsing updates: %v", err)
 	}
+	return response.Result, nil
+}
 
-	context.Mutex.Lock()
-	addToContext(context, "bot", response, true)
-	context.Mutex.Unlock()
+// envOrDefault returns the environment variable name, or fallback if unset
+func envOrDefault(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
 }
 
 func main() {
-	config, err := loadConfig()
+	configPath := flag.String("config", envOrDefault("CONFIG_PATH", "config.json"), "path to the config file (env CONFIG_PATH)")
+	statusPath := flag.String("status", envOrDefault("STATUS_PATH", "status.json"), "path to the chat status file (env STATUS_PATH)")
+	flag.Parse()
+
+	config, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatal("Configuration error:", err)
 	}
 
-	status, err := loadBotStatus()
+	logLevel, _ = parseLogLevel(config.LogLevel)
+
+	status, err := loadBotStatus(*statusPath)
 	if err != nil {
 		log.Fatal("Status loading error:", err)
 	}
 
+	client := newHTTPClient(config)
+
+	provider, err := newLLMProvider(config, client)
+	if err != nil {
+		log.Fatal("Provider error:", err)
+	}
+
+	requestSlots = make(chan struct{}, config.MaxConcurrentRequests)
+	if config.CircuitBreakerFailures > 0 {
+		llmBreaker = NewCircuitBreaker(config.CircuitBreakerFailures, time.Duration(config.CircuitBreakerCooldownSeconds)*time.Second)
+	}
+
+	if !config.SkipModelValidation {
+		go validateModel(client, config)
+	}
+
+	if config.TranscriptFile != "" {
+		transcriptLog, err = NewTranscriptWriter(config.TranscriptFile, config.TranscriptMaxBytes)
+		if err != nil {
+			log.Fatal("Transcript error:", err)
+		}
+	}
+
 	// Create context manager instead of single context
-	contextManager := NewContextManager(config)
+	contextManager := NewContextManager(config, status)
+
+	// Reactions are only delivered when asked for explicitly
+	reconnecting := &ReconnectingPoller{Timeout: 10 * time.Second, AllowedUpdates: telebot.AllowedUpdates}
+	var poller telebot.Poller = reconnecting
+	if config.WebhookURL != "" {
+		poller = &telebot.Webhook{
+			Listen:         config.WebhookListen,
+			SecretToken:    config.WebhookSecret,
+			Endpoint:       &telebot.WebhookEndpoint{PublicURL: config.WebhookURL},
+			AllowedUpdates: telebot.AllowedUpdates,
+		}
+	}
+
+	// Every update received shows the connection to Telegram is working.
+	// telebot has no endpoint for reactions, so they are picked off here
+	// and handled in the background to keep the poller moving.
+	poller = telebot.NewMiddlewarePoller(poller, func(update *telebot.Update) bool {
+		markAlive()
+		if update.MessageReaction != nil {
+			go handleReaction(contextManager, config, update.MessageReaction)
+		}
+		return true
+	})
 
 	pref := telebot.Settings{
 		Token:  config.TelegramToken,
-		Poller: &telebot.LongPoller{Timeout: 10 * time.Second},
+		Poller: poller,
+		Client: newTelegramClient(config),
 	}
 
-	bot, err := telebot.NewBot(pref)
+	bot, err := newBotWithRetry(pref)
 	if err != nil {
 		log.Fatal("Bot creation error:", err)
 	}
 
-	bot.Handle(telebot.OnText, func(c telebot.Context) error {
+	if config.WebhookURL != "" {
+		logInfo("Receiving updates by webhook at %s (listening on %s)", config.WebhookURL, config.WebhookListen)
+	} else if err := bot.RemoveWebhook(); err != nil {
+		// Telegram refuses to long poll while a webhook is registered
+		logWarn("Failed to remove webhook: %v", err)
+	}
+
+	onMessage := func(c telebot.Context) error {
 		message := c.Message()
 
 		if message.Sender.ID == bot.Me.ID {
@@ -575,15 +5733,81 @@ func main() {
 		}
 
 		// Pass contextManager instead of single context
-		go handleIncomingMessage(bot, contextManager, config, status, message)
+		go handleIncomingMessage(bot, contextManager, config, client, provider, status, message)
 		return nil
-	})
+	}
+
+	bot.Handle(telebot.OnText, onMessage)
+	// Media is only seen for its caption unless vision is enabled
+	bot.Handle(telebot.OnPhoto, onMessage)
+	bot.Handle(telebot.OnVideo, onMessage)
+	bot.Handle(telebot.OnAnimation, onMessage)
+	bot.Handle(telebot.OnDocument, onMessage)
+	bot.Handle(telebot.OnAudio, onMessage)
+	if config.TranscriptionURL != "" {
+		bot.Handle(telebot.OnVoice, onMessage)
+	}
+
+	if config.MembershipNotes {
+		bot.Handle(telebot.OnUserJoined, func(c telebot.Context) error {
+			handleMembership(contextManager, config, status, c.Chat(), c.Message().UserJoined, true)
+			return nil
+		})
+		bot.Handle(telebot.OnUserLeft, func(c telebot.Context) error {
+			handleMembership(contextManager, config, status, c.Chat(), c.Message().UserLeft, false)
+			return nil
+		})
+	}
 
 	// Note: OnChatMember requires admin permissions, so we track chats via messages instead
 
-	log.Println("Bot starting...")
+	if config.ProactiveEnabled {
+		go runProactive(bot, contextManager, config, provider, status)
+	}
+
+	go logDailyUsage(contextManager, config)
+
+	logInfo("Bot starting...")
+
+	if config.DryRun {
+		logInfo("Dry run: replies are logged, not sent")
+	} else {
+		go sendStartupNotifications(bot, status, config)
+	}
+
+	if config.HealthListen != "" {
+		markAlive()
+		go runHeartbeat(bot)
+		go serveHealth(config.HealthListen)
+	}
+
+	stopAutosave := make(chan struct{})
+	go status.autosave(stopAutosave)
+	if transcriptLog != nil {
+		go transcriptLog.autoflush(stopAutosave)
+	}
 
-	go sendStartupNotifications(bot, status, config)
+	// Stop polling on SIGINT/SIGTERM so pending status changes are saved
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logInfo("Received %v, shutting down", sig)
+		bot.Stop()
+	}()
 
 	bot.Start()
+
+	close(stopAutosave)
+	if err := status.flush(true); err != nil {
+		logError("Failed to save chat status on shutdown: %v", err)
+	}
+	if err := transcriptLog.flush(); err != nil {
+		logError("Failed to write transcript on shutdown: %v", err)
+	}
+	logInfo("Bot stopped")
+
+	if reconnecting.Err != nil {
+		os.Exit(1)
+	}
 }